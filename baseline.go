@@ -0,0 +1,181 @@
+// dcc - dependency-driven C/C++ compiler front end
+//
+// Copyright © A.Newman 2015.
+//
+// This source code is released under version 2 of the  GNU Public License.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Warning baselines.
+//
+// A legacy code base may have too many warnings to use -Werror but we
+// can stop the number of warnings growing. A warning baseline is a
+// file listing the warnings that are known, and accepted. Builds fail
+// if they produce any warning not in the baseline.
+//
+// Warnings are identified by the file in which they occur, the check
+// that produced them and their message. Line and column numbers are
+// not used as they change as code is edited, and any numbers in the
+// message, other than those within quotes or forming part of a word,
+// e.g. a variable's name, are replaced with "N". File names are
+// relative to the
+// directory containing the baseline file so the baseline can be
+// committed alongside the code.
+//
+// The baseline file has one line per warning. Each line has the tab
+// separated file name, check and normalized message. The same warning
+// may occur more than once. Every occurrence is counted, including
+// a warning in a header file reported by each source including it.
+//
+
+const warningBaselineHeader = "# dcc warning baseline - generated by --update-warning-baseline"
+
+// WarningBaseline is the content of a warning baseline file, a count
+// of the occurrences of each warning.
+//
+type WarningBaseline struct {
+	dir    string         // directory containing the baseline file
+	counts map[string]int // warning key -> occurrences
+}
+
+var (
+	numbers = regexp.MustCompile(`\b[0-9]+\b`)
+	quoted  = regexp.MustCompile(`'[^']*'|‘[^’]*’|"[^"]*"`)
+)
+
+// NewWarningBaseline returns a new, empty, WarningBaseline for the
+// named baseline file.
+//
+func NewWarningBaseline(path string) *WarningBaseline {
+	return &WarningBaseline{
+		dir:    filepath.Dir(absPath(path)),
+		counts: make(map[string]int),
+	}
+}
+
+// ReadWarningBaseline reads a warning baseline file.
+//
+func ReadWarningBaseline(path string) (*WarningBaseline, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	b := NewWarningBaseline(path)
+	input := bufio.NewScanner(file)
+	for input.Scan() {
+		if line := input.Text(); line != "" && line[0] != '#' {
+			b.counts[line]++
+		}
+	}
+	return b, input.Err()
+}
+
+// Key returns the string used to identify a warning in the receiver.
+//
+func (b *WarningBaseline) Key(d Diagnostic) string {
+	file := absPath(d.File)
+	if rel, err := filepath.Rel(b.dir, file); err == nil {
+		file = rel
+	}
+	message := normalizeNumbers(strings.Join(strings.Fields(d.Message), " "))
+	return filepath.ToSlash(file) + "\t" + d.Check + "\t" + message
+}
+
+// normalizeNumbers replaces the numbers in a warning's message with
+// "N" leaving any quoted text, e.g. the names of variables, as is.
+//
+func normalizeNumbers(message string) string {
+	var b strings.Builder
+	start := 0
+	for _, span := range quoted.FindAllStringIndex(message, -1) {
+		b.WriteString(numbers.ReplaceAllString(message[start:span[0]], "N"))
+		b.WriteString(message[span[0]:span[1]])
+		start = span[1]
+	}
+	b.WriteString(numbers.ReplaceAllString(message[start:], "N"))
+	return b.String()
+}
+
+// NewWarnings returns the warnings not in the receiver. A warning
+// that occurs more often than the baseline permits is new.
+//
+func (b *WarningBaseline) NewWarnings(warnings []Diagnostic) []Diagnostic {
+	remaining := make(map[string]int, len(b.counts))
+	for key, count := range b.counts {
+		remaining[key] = count
+	}
+	var unexpected []Diagnostic
+	for _, d := range warnings {
+		key := b.Key(d)
+		if remaining[key] > 0 {
+			remaining[key]--
+		} else {
+			unexpected = append(unexpected, d)
+		}
+	}
+	return unexpected
+}
+
+// WriteWarningBaseline writes a baseline file listing the given
+// warnings. Lines are sorted to make changes to the file easy to
+// review.
+//
+func WriteWarningBaseline(path string, warnings []Diagnostic) error {
+	b := NewWarningBaseline(path)
+	lines := make([]string, 0, len(warnings)+1)
+	for _, d := range warnings {
+		lines = append(lines, b.Key(d))
+	}
+	sort.Strings(lines)
+	lines = append([]string{warningBaselineHeader}, lines...)
+	return ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0666)
+}
+
+// checkWarningBaseline compares the warnings collected during the
+// build with those in the warning baseline file and returns false if
+// there are any new warnings, which are reported. If update is true
+// the baseline file is instead re-written with the current warnings.
+//
+func checkWarningBaseline(path string, update bool) bool {
+	warnings := Diagnostics.Warnings()
+	if update {
+		if err := WriteWarningBaseline(path, warnings); err != nil {
+			log.Print(err)
+			return false
+		}
+		if !Quiet {
+			log.Printf("%s: %d warnings", path, len(warnings))
+		}
+		return true
+	}
+	baseline, err := ReadWarningBaseline(path)
+	if os.IsNotExist(err) {
+		baseline = NewWarningBaseline(path)
+	} else if err != nil {
+		log.Print(err)
+		return false
+	}
+	unexpected := baseline.NewWarnings(warnings)
+	for _, d := range unexpected {
+		log.Print(d.String())
+	}
+	if len(unexpected) > 0 {
+		log.Printf("%d new warnings not in the warning baseline %s", len(unexpected), path)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,145 @@
+// dcc - dependency-driven C/C++ compiler front end
+//
+// Copyright © A.Newman 2015.
+//
+// This source code is released under version 2 of the  GNU Public License.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// Built-in variables.
+//
+// dcc defines a number of variables describing itself and the build
+// that options files may use, in expansions and conditionals, in the
+// same way as environment variables (see variables.go).
+//
+//	DCC_OS			the operating system, e.g. linux
+//	DCC_ARCH		the architecture, e.g. amd64
+//	DCC_COMPILER		the compiler family, e.g. gcc, clang
+//	DCC_COMPILER_VERSION	the compiler's version number
+//	DCC_MODE		exe, lib, dll, plugin or compile
+//	DCC_OUTPUT		the program or library being created
+//	DCC_OBJDIR		the object file directory
+//	DCC_ROOT		the directory of the options file being read
+//
+// DCC_COMPILER_VERSION requires running the compiler so is only
+// determined if it is used.
+//
+
+const (
+	BuiltinOS              = "DCC_OS"
+	BuiltinArch            = "DCC_ARCH"
+	BuiltinCompiler        = "DCC_COMPILER"
+	BuiltinCompilerVersion = "DCC_COMPILER_VERSION"
+	BuiltinMode            = "DCC_MODE"
+	BuiltinOutput          = "DCC_OUTPUT"
+	BuiltinObjdir          = "DCC_OBJDIR"
+	BuiltinRoot            = "DCC_ROOT"
+)
+
+var (
+	builtinsMutex sync.Mutex
+	builtins      = map[string]func() string{
+		BuiltinOS:   func() string { return runtime.GOOS },
+		BuiltinArch: func() string { return runtime.GOARCH },
+	}
+)
+
+// SetBuiltin defines the value of a built-in variable.
+//
+func SetBuiltin(name, value string) {
+	builtinsMutex.Lock()
+	defer builtinsMutex.Unlock()
+	builtins[name] = func() string { return value }
+}
+
+// SetLazyBuiltin defines a built-in variable whose value is
+// determined, once, when it is first used.
+//
+func SetLazyBuiltin(name string, value func() string) {
+	var once sync.Once
+	var result string
+	builtinsMutex.Lock()
+	defer builtinsMutex.Unlock()
+	builtins[name] = func() string {
+		once.Do(func() { result = value() })
+		return result
+	}
+}
+
+// LookupBuiltin returns the value of a built-in variable. DCC_ROOT
+// depends upon the options file being read, named by filename.
+//
+func LookupBuiltin(name, filename string) (string, bool) {
+	if name == BuiltinRoot {
+		if dir, err := filepath.Abs(Dirname(filename)); err == nil {
+			return dir, true
+		}
+		return Dirname(filename), true
+	}
+	builtinsMutex.Lock()
+	value, found := builtins[name]
+	builtinsMutex.Unlock()
+	if !found {
+		return "", false
+	}
+	return value(), true
+}
+
+// PrescanArgs determines the running mode, output file and object
+// file directory from the command line arguments, as needed by the
+// built-in variables, before the options files, and then the
+// arguments proper, are read.
+//
+func PrescanArgs(args []string) (mode, output, objdir string) {
+	dasho := ""
+	objdir = ObjsDir
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		param := func() string {
+			if i+1 < len(args) {
+				i++
+				return args[i]
+			}
+			return ""
+		}
+		switch {
+		case arg == "--exe", arg == "--lib", arg == "--dll", arg == "--plugin":
+			mode, output = arg[2:], param()
+		case arg == "-c":
+			if mode == "" {
+				mode = "compile"
+			}
+		case arg == "--objdir":
+			objdir = param()
+		case arg == "--define":
+			param()
+		case arg == "-o":
+			if dasho == "" {
+				dasho = param()
+			}
+		case strings.HasPrefix(arg, "-o"):
+			if dasho == "" {
+				dasho = arg[2:]
+			}
+		}
+	}
+	if mode == "" {
+		mode = "exe"
+	}
+	if output == "" {
+		output = dasho
+	}
+	if output == "" && mode == "exe" {
+		output = platform.DefaultExecutable
+	}
+	return mode, output, objdir
+}
@@ -11,10 +11,13 @@ package main
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/atrn/par"
 )
@@ -22,21 +25,56 @@ import (
 // CompileAll compiles all of the given sources using the supplied
 // options and returns true if all were sucessfully compiled.
 //
-// CompileAll compiles the sources in parallel using, up to, NJOBS
-// parallel compilations.
+// CompileAll works in two phases. It first determines which sources
+// need to be compiled, checking them concurrently, and then compiles
+// those sources in parallel using, up to, NJOBS parallel
+// compilations.
 //
 func CompileAll(sources []string, options *Options, objdir string) (ok bool) {
 	// Assume success.
 	//
 	ok = true
 
-	// The standard error output of each compile is routed via an
-	// OutputMux which ensures output is not interleaved. We don't
-	// bother with standard output yet but probably should.
+	// Dependencies are read from the object directory's dependency
+	// database, updated as files are compiled and written back
+	// when we're done.
 	//
-	mux := NewOutputMux(os.Stderr)
+	db := LoadDepsDatabase(DepsDatabasePath(objdir))
+	defer func() {
+		if err := db.Save(); err != nil {
+			log.Print(err)
+		}
+	}()
+
+	// The output, standard output and standard error, of each
+	// compile is routed via an OutputMux which ensures output is
+	// not interleaved. Each compile's output is also saved to a
+	// log file alongside the object file's dependencies.
+	//
+	// With --dedup-diagnostics the mux also removes diagnostics
+	// that have already been output, i.e. those in header files.
+	//
+	mux := NewOutputMux(Status.Writer(os.Stderr))
+	if DedupDiagnostics {
+		mux.EnableDedup()
+	}
 	defer mux.Close()
 
+	// Scan phase. Find the sources that need compiling and say
+	// how many, before any compiler is run.
+	//
+	stale, ok := ScanAll(sources, options, objdir, db, mux)
+	if !Quiet {
+		if len(stale) == 0 {
+			log.Print("nothing to do")
+		} else {
+			log.Printf("%d of %d files need compiling", len(stale), len(sources))
+		}
+	}
+	if len(stale) == 0 {
+		return
+	}
+
 	// Our process structure is a simple fan-out that feeds the
 	// names of the source files to a number of "workers" for
 	// compilation.
@@ -49,23 +87,49 @@ func CompileAll(sources []string, options *Options, objdir string) (ok bool) {
 	//
 	// Synchronization is done by par.DO and par.FOR.
 	//
-	filenames := make(chan string, len(sources))
-	errs := make(chan error, len(sources))
+	// With --max-errors workers stop compiling once the limit on
+	// the number of errors is reached. Compiles in progress are
+	// completed and any remaining sources are not compiled, they're
+	// recorded as skipped due to too many errors.
+	//
+	filenames := make(chan string, len(stale))
+	errs := make(chan error, len(stale))
+	limit := NewErrorLimit(MaxErrors)
+	Status.AddTotal(len(stale))
+	defer Status.Done()
 
 	par.DO(
 		func() {
-			for _, filename := range sources {
+			for _, filename := range stale {
+				Report.Schedule(&Action{Kind: ActionCompile, Source: filename, Target: ObjectFilename(filename, objdir), Worker: -1})
 				filenames <- filename
 			}
 			close(filenames)
 		},
 		func() {
-			par.FOR(0, NumJobs, func(int) {
+			par.FOR(0, NumJobs, func(worker int) {
 				for filename := range filenames {
 					ofile := ObjectFilename(filename, objdir)
-					stderr := mux.NewWriter()
-					errs <- Compile(filename, options, ofile, stderr, objdir)
-					stderr.Close()
+					if limit.Reached() {
+						Report.Record(&Action{Kind: ActionCompile, Source: filename, Target: ofile, Worker: -1, Skipped: true, Reason: TooManyErrors})
+						continue
+					}
+					output := mux.NewWriter(LogFilename(ofile))
+					action := &Action{Kind: ActionCompile, Source: filename, Target: ofile, Worker: worker}
+					Report.Begin(action)
+					err := Compile(filename, options, ofile, output, objdir, db)
+					action.End, action.Err, action.Output = time.Now(), err, output.Bytes()
+					Report.Record(action)
+					if Diagnostics != nil {
+						Diagnostics.Add(output.Bytes())
+					}
+					if err := output.Close(); err != nil {
+						log.Print(err)
+					}
+					if err != nil && limit.Add(output.Bytes()) {
+						log.Printf("stopping, too many errors (--max-errors %d)", MaxErrors)
+					}
+					errs <- err
 				}
 			})
 			close(errs)
@@ -83,9 +147,184 @@ func CompileAll(sources []string, options *Options, objdir string) (ok bool) {
 	return
 }
 
-// Compile a single source file, if required. Returns a non-nil error if compilation fails.
+// TooManyErrors is the reason recorded for the compiles not done
+// once the --max-errors limit is reached.
+//
+const TooManyErrors = "too many errors"
+
+// ErrorLimit limits the number of errors in a build. An ErrorLimit
+// may be used concurrently.
+//
+type ErrorLimit struct {
+	mutex   sync.Mutex
+	limit   int
+	nerrors int
+}
+
+// NewErrorLimit returns an ErrorLimit for the given number of errors.
+// A limit of zero, or less, is no limit.
+//
+func NewErrorLimit(limit int) *ErrorLimit {
+	return &ErrorLimit{limit: limit}
+}
+
+// Add counts the errors in the output of a failed compile and
+// returns true if this reaches the receiver's limit. A failed compile
+// always counts as at least one error.
+//
+func (e *ErrorLimit) Add(output []byte) bool {
+	n := 0
+	for _, d := range ParseDiagnostics(output) {
+		if d.IsError() {
+			n++
+		}
+	}
+	if n == 0 {
+		n = 1
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	wasReached := e.reached()
+	e.nerrors += n
+	return !wasReached && e.reached()
+}
+
+// Reached returns true if the receiver's limit has been reached.
+//
+func (e *ErrorLimit) Reached() bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.reached()
+}
+
+func (e *ErrorLimit) reached() bool {
+	return e.limit > 0 && e.nerrors >= e.limit
+}
+
+// ScanAll determines which of the given sources need to be compiled
+// and returns their names, in the order they were supplied, and true
+// if no errors occurred. Any errors are reported as they occur. Any
+// output replayed for up to date files is written via the mux.
+//
+// Sources are checked concurrently. Most sources share the same
+// header files and Stat ensures each unique path is only stat'd
+// once regardless of the number of sources depending upon it.
+//
+func ScanAll(sources []string, options *Options, objdir string, db *DepsDatabase, mux *OutputMux) ([]string, bool) {
+	required := make([]bool, len(sources))
+	errs := make([]error, len(sources))
+	next := make(chan int, len(sources))
+	for index := range sources {
+		next <- index
+	}
+	close(next)
+
+	par.FOR(0, NumJobs, func(worker int) {
+		for index := range next {
+			ofile := ObjectFilename(sources[index], objdir)
+			action := &Action{Kind: ActionScan, Source: sources[index], Target: ofile, Worker: worker}
+			Report.Begin(action)
+			required[index], errs[index] = CompileRequired(sources[index], options, ofile, db)
+			action.End, action.Err = time.Now(), errs[index]
+			Report.Record(action)
+		}
+	})
+
+	ok := true
+	stale := make([]string, 0, len(sources))
+	for index, filename := range sources {
+		if errs[index] != nil {
+			log.Print(errs[index])
+			ok = false
+		} else if required[index] {
+			stale = append(stale, filename)
+		} else {
+			ofile := ObjectFilename(filename, objdir)
+			Report.Record(&Action{Kind: ActionCompile, Source: filename, Target: ofile, Worker: -1, Skipped: true, Reason: "up to date"})
+			if ReplayWarnings {
+				output := mux.NewWriter("")
+				ReplayOutput(ofile, output)
+				output.Close()
+			}
+			if Diagnostics != nil {
+				Diagnostics.Add(SavedOutput(ofile))
+			}
+		}
+	}
+	return stale, ok
+}
+
+// ReplayOutput writes the saved output of the last compilation of an
+// object file to the given io.Writer. This is used to re-output the
+// warnings for object files that are up to date and so not compiled.
+//
+func ReplayOutput(ofile string, w io.Writer) {
+	if data := SavedOutput(ofile); len(data) > 0 {
+		w.Write(data)
+	}
+}
+
+// SavedOutput returns the saved output of the last compilation of an
+// object file, or nil if there is none.
 //
-func Compile(filename string, options *Options, ofile string, stderr io.WriteCloser, objdir string) error {
+func SavedOutput(ofile string) []byte {
+	data, err := ioutil.ReadFile(LogFilename(ofile))
+	if err != nil && !os.IsNotExist(err) {
+		log.Print(err)
+	}
+	return data
+}
+
+// CompileRequired determines if a source file needs to be compiled
+// to create, or update, the given object file.
+//
+// Dependencies are obtained via the supplied dependency database. If
+// db is nil the compiler's dependency file is used directly.
+//
+func CompileRequired(filename string, options *Options, ofile string, db *DepsDatabase) (bool, error) {
+	if IgnoreDependencies {
+		return true, nil
+	}
+	sourceInfo, err := Stat(filename)
+	if err != nil {
+		return false, err
+	}
+	target, deps, err := readDependencies(ofile, DepsFilename(ofile), db)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	} else if filepath.Base(target) != filepath.Base(ofile) {
+		log.Printf("WARNING: got dependency target %q for object file %q", target, ofile)
+	}
+	uptodate, err := IsUptoDate(ofile, deps, sourceInfo, options)
+	return !uptodate, err
+}
+
+// readDependencies returns the dependencies of an object file. These
+// come from the daemon, if there is one, or the dependency database,
+// if there is one, or the compiler-generated dependency file.
+//
+func readDependencies(ofile, depsFilename string, db *DepsDatabase) (string, []string, error) {
+	if Daemon != nil {
+		if target, deps, err := Daemon.Dependencies(depsFilename); err != ErrDaemon {
+			return target, deps, err
+		}
+	}
+	if db != nil {
+		return db.Dependencies(ofile, depsFilename)
+	}
+	return ActualCompiler.ReadDependencies(depsFilename)
+}
+
+// Compile a single source file. Returns a non-nil error if
+// compilation fails.
+//
+// The compiler's output is written to the supplied io.Writer. The
+// supplied dependency database, if not nil, is updated with the
+// dependencies generated by the compiler.
+//
+func Compile(filename string, options *Options, ofile string, output io.Writer, objdir string, db *DepsDatabase) error {
 	if ofile == "" {
 		ofile = ObjectFilename(filename, objdir)
 	}
@@ -100,29 +339,13 @@ func Compile(filename string, options *Options, ofile string, stderr io.WriteClo
 			return err
 		}
 	}
-	if !IgnoreDependencies {
-		sourceInfo, err := Stat(filename)
-		if err != nil {
-			return err
-		}
-		target, deps, err := ActualCompiler.ReadDependencies(depsFilename)
-		if os.IsNotExist(err) {
-			// ignore
-		} else if err != nil {
-			return err
-		} else if filepath.Base(target) != filepath.Base(ofile) {
-			log.Printf("WARNING: got dependency target %q for object file %q", target, ofile)
-		}
-		if err == nil {
-			uptodate, err := IsUptoDate(ofile, deps, sourceInfo, options)
-			if err != nil || uptodate {
-				return err
-			}
-		}
-	}
 
 	// Compile the file.
 	//
+	// Remember the existing object's state so we can tell if
+	// re-compiling it actually changes anything.
+	//
+	prev := PreviousObjectState(ofile)
 
 	ClearCachedStat(ofile) // it will change
 
@@ -130,23 +353,39 @@ func Compile(filename string, options *Options, ofile string, stderr io.WriteClo
 	// the raw command as we'll add options to it. So we
 	// prepare something similar for the user.
 	//
+	// The status line (status.go) displays the command and counts
+	// the compile even when nothing is displayed.
+	//
+	var displayed []string
 	if !Quiet {
-		var displayed []string
 		if Verbose {
-			displayed = append(displayed, ActualCompiler.Name())
-			displayed = append(displayed, options.Values...)
-			displayed = append(displayed, filename)
-			if objdir != "" {
-				displayed = append(displayed, "-o", ofile)
-			}
+			displayed = ActualCompiler.CompileCommand(filename, ofile, options.Values)
 		} else {
 			displayed = append(displayed, ActualCompiler.Name())
 			displayed = append(displayed, filename)
 		}
-		fmt.Fprintln(os.Stdout, strings.Join(displayed, " "))
+	}
+	Status.Start(strings.Join(displayed, " "))
+	err := ActualCompiler.Compile(filename, ofile, depsFilename, options.Values, output)
+	Status.Finish(err == nil)
+	if err != nil {
+		return err
+	}
+
+	if db != nil {
+		if err := db.Ingest(ofile, depsFilename); err != nil {
+			return err
+		}
 	}
 
-	return ActualCompiler.Compile(filename, ofile, depsFilename, options.Values, stderr)
+	unchanged, err := RecordObjectState(ofile, prev)
+	if err != nil {
+		return err
+	}
+	if unchanged && Debug {
+		log.Printf("DEPS: %q unchanged by re-compilation", ofile)
+	}
+	return nil
 }
 
 // IsUptoDate determines if a given target file is up to date with
@@ -192,9 +431,38 @@ func IsUptoDate(target string, deps []string, sourceInfo os.FileInfo, options *O
 		return outOfDate("compiler options file newer than target")
 	case FileIsNewer(options.FileInfo(), targetInfo):
 		return outOfDate("compiler options file newer than target")
+	case ActualToolchain != nil && ActualToolchain.ModTime.After(targetInfo.ModTime()):
+		return outOfDate("toolchain newer than target")
+	}
+	if ActualToolchain != nil {
+		userDeps := make([]string, 0, len(deps))
+		for _, filename := range deps {
+			if !ActualToolchain.IsSystemHeader(filename) {
+				userDeps = append(userDeps, filename)
+			}
+		}
+		deps = userDeps
+	}
+
+	// Dependencies are stat'd by the daemon, if there is one, in
+	// a single request. Otherwise we stat them as we go.
+	//
+	var infos []os.FileInfo
+	var errs []error
+	if Daemon != nil {
+		if infos, errs, err = Daemon.StatAll(deps); err != nil {
+			infos = nil
+		}
 	}
-	for _, filename := range deps {
-		switch depInfo, err := Stat(filename); {
+
+	for index, filename := range deps {
+		var depInfo os.FileInfo
+		if infos != nil {
+			depInfo, err = infos[index], errs[index]
+		} else {
+			depInfo, err = Stat(filename)
+		}
+		switch {
 		case os.IsNotExist(err):
 			return outOfDate(fmt.Sprintf("%q: dependent file does not exist", filename))
 		case err != nil:
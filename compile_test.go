@@ -0,0 +1,111 @@
+// dcc - dependency-driven C/C++ compiler front end
+//
+// Copyright © A.Newman 2015.
+//
+// This source code is released under version 2 of the  GNU Public License.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testCompiler is a Compiler whose Compile method is supplied by a
+// test.
+//
+type testCompiler struct {
+	Compiler
+	compile func(source string, w io.Writer) error
+}
+
+func (c *testCompiler) Compile(source, object, deps string, options []string, w io.Writer) error {
+	return c.compile(source, w)
+}
+
+func TestMaxErrors(t *testing.T) {
+	setupTest(t)
+	defer removeTestDirs(t)
+
+	savedCompiler, savedJobs, savedMaxErrors, savedQuiet, savedReport := ActualCompiler, NumJobs, MaxErrors, Quiet, Report
+	defer func() {
+		ActualCompiler, NumJobs, MaxErrors, Quiet, Report = savedCompiler, savedJobs, savedMaxErrors, savedQuiet, savedReport
+		log.SetOutput(os.Stderr)
+	}()
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	NumJobs, MaxErrors, Quiet, Report = 2, 1, true, NewBuildReport()
+
+	var sources []string
+	for _, name := range []string{"a.c", "b.c", "c.c", "d.c"} {
+		path := filepath.Join(testProjectRootDir, name)
+		makeFile(t, path)
+		sources = append(sources, path)
+	}
+
+	// a.c fails while b.c is being compiled. b.c fails once a.c has
+	// failed, after the limit has been reached. c.c and d.c are not
+	// compiled.
+	//
+	var mutex sync.Mutex
+	var compiled []string
+	bStarted, aFailed := make(chan struct{}), make(chan struct{})
+	ActualCompiler = &testCompiler{
+		Compiler: NewGccStyleCompiler("cc"),
+		compile: func(source string, w io.Writer) error {
+			name := filepath.Base(source)
+			mutex.Lock()
+			compiled = append(compiled, name)
+			mutex.Unlock()
+			switch name {
+			case "a.c":
+				<-bStarted
+				defer close(aFailed)
+			case "b.c":
+				close(bStarted)
+				<-aFailed
+			}
+			fmt.Fprintf(w, "%s:1:1: error: expected ';'\n", source)
+			return errors.New(name + " failed")
+		},
+	}
+
+	objdir := filepath.Join(testProjectRootDir, "obj")
+	if CompileAll(sources, NewOptions(), objdir) {
+		t.Fatal("CompileAll succeeded")
+	}
+
+	sort.Strings(compiled)
+	if strings.Join(compiled, " ") != "a.c b.c" {
+		t.Errorf("compiled %q, expected a.c and b.c", compiled)
+	}
+	for _, expected := range []string{"a.c failed", "stopping, too many errors", "b.c failed"} {
+		if !strings.Contains(logged.String(), expected) {
+			t.Errorf("%q not reported, got:\n%s", expected, logged.String())
+		}
+	}
+
+	// The sources not compiled are reported as skipped.
+	//
+	var skipped []string
+	for _, a := range Report.Actions() {
+		if a.Kind == ActionCompile && a.Skipped && a.Reason == TooManyErrors {
+			skipped = append(skipped, filepath.Base(a.Source))
+		}
+	}
+	sort.Strings(skipped)
+	if strings.Join(skipped, " ") != "c.c d.c" {
+		t.Errorf("skipped %q, expected c.c and d.c", skipped)
+	}
+}
@@ -11,24 +11,91 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"log"
 	"os"
+	"path/filepath"
 )
 
 const CompileCommandsFilename = "compile_commands.json"
 
+// CompileCommand is an entry in a compile_commands.json file, a JSON
+// compilation database as defined by clang. We write the arguments
+// form but also read entries using the command form. The file is
+// always an absolute path.
+//
 type CompileCommand struct {
-	Directory string `json:"directory"`
-	Command   string `json:"command"`
-	File      string `json:"file"`
+	Directory string   `json:"directory"`
+	Arguments []string `json:"arguments,omitempty"`
+	Command   string   `json:"command,omitempty"`
+	File      string   `json:"file"`
+	Output    string   `json:"output,omitempty"`
+}
+
+// abs returns the absolute form of a path in the receiver, relative
+// paths are relative to its directory.
+//
+func (cc *CompileCommand) abs(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(cc.Directory, path)
+}
+
+// key returns the string identifying the receiver's compilation,
+// the absolute paths of its file and output.
+//
+func (cc *CompileCommand) key() string {
+	return cc.abs(cc.File) + "\x00" + cc.abs(cc.Output)
 }
 
 func makeCompileCommands(sourceFilenames []string, compilerOptions *Options, objdir string) []CompileCommand {
 	commands := make([]CompileCommand, len(sourceFilenames))
 	for index, sourceFile := range sourceFilenames {
-		command := fmt.Sprintf("%s %s -o %s -c %s", ActualCompiler.Name(), compilerOptions.String(), ObjectFilename(sourceFile, objdir), sourceFile)
+		ofile := ObjectFilename(sourceFile, objdir)
 		commands[index].Directory = DccCurrentDirectory
-		commands[index].Command = command
-		commands[index].File = sourceFile
+		commands[index].Arguments = ActualCompiler.CompileCommand(sourceFile, ofile, compilerOptions.Values)
+		commands[index].File = absPath(sourceFile)
+		commands[index].Output = ofile
+	}
+	return commands
+}
+
+// mergeCompileCommands returns the commands with any of the updates
+// replacing the existing commands for the same file and output.
+// Commands without an output, e.g. those written by older versions
+// of dcc or other tools, are replaced by any command for the same
+// file. New commands are added to the end.
+//
+func mergeCompileCommands(commands []CompileCommand, updates []CompileCommand) []CompileCommand {
+	index := make(map[string]int, len(commands))
+	noOutput := make(map[string]int)
+	for i := range commands {
+		index[commands[i].key()] = i
+		if commands[i].Output == "" {
+			noOutput[commands[i].abs(commands[i].File)] = i
+		}
+	}
+	for _, update := range updates {
+		file := update.abs(update.File)
+		i, found := index[update.key()]
+		if !found {
+			i, found = noOutput[file]
+		}
+		if found {
+			delete(index, commands[i].key())
+			if commands[i].Output == "" {
+				delete(noOutput, commands[i].abs(commands[i].File))
+			}
+			commands[i] = update
+		} else {
+			i = len(commands)
+			commands = append(commands, update)
+		}
+		index[update.key()] = i
+		if update.Output == "" {
+			noOutput[file] = i
+		}
 	}
 	return commands
 }
@@ -48,8 +115,16 @@ func readCompileCommands(jsonFilename string) ([]CompileCommand, error) {
 	return commands, nil
 }
 
+// writeCompileCommands writes a compile_commands.json file. The file
+// is written to a temporary file that is then renamed so readers,
+// e.g. clangd, never see a partially written file.
+//
 func writeCompileCommands(jsonFilename string, commands []CompileCommand) error {
-	file, err := os.Create(jsonFilename)
+	dir := filepath.Dir(jsonFilename)
+	if err := Mkdir(dir); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(dir, CompileCommandsFilename+".*")
 	if err != nil {
 		return err
 	}
@@ -59,6 +134,12 @@ func writeCompileCommands(jsonFilename string, commands []CompileCommand) error
 	if err2 := file.Close(); err == nil {
 		err = err2
 	}
+	if err == nil {
+		err = os.Rename(file.Name(), jsonFilename)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
 	return err
 }
 
@@ -66,11 +147,64 @@ func WriteCompileCommandsDotJson(jsonFilename string, sourceFilenames []string,
 	return writeCompileCommands(jsonFilename, makeCompileCommands(sourceFilenames, compilerOptions, objdir))
 }
 
+// AppendCompileCommandsDotJson adds the commands to compile the
+// source files to a compile_commands.json file. Many dcc processes
+// may append to the same file at the same time so the file is
+// locked while it is updated.
+//
 func AppendCompileCommandsDotJson(jsonFilename string, sourceFilenames []string, compilerOptions *Options, objdir string) error {
+	if err := Mkdir(filepath.Dir(jsonFilename)); err != nil {
+		return err
+	}
+	unlock, err := LockFile(jsonFilename)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	commands, err := readCompileCommands(jsonFilename)
 	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
-	commands = append(commands, makeCompileCommands(sourceFilenames, compilerOptions, objdir)...)
+	commands = mergeCompileCommands(commands, makeCompileCommands(sourceFilenames, compilerOptions, objdir))
+	return writeCompileCommands(jsonFilename, commands)
+}
+
+// MergeCompileCommands assembles a single compile_commands.json file
+// from the compile_commands.json files found in the named directories
+// and their sub-directories, e.g. the object directories of a tree
+// of projects. Entries for the same file and output are merged, the
+// last one found wins. The output file itself is not an input.
+//
+func MergeCompileCommands(jsonFilename string, dirs []string) error {
+	output, err := filepath.Abs(jsonFilename)
+	if err != nil {
+		return err
+	}
+	var commands []CompileCommand
+	for _, dir := range dirs {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || info.Name() != CompileCommandsFilename {
+				return nil
+			}
+			if abs, err := filepath.Abs(path); err != nil || abs == output {
+				return err
+			}
+			found, err := readCompileCommands(path)
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			if Debug {
+				log.Printf("MERGE: %d commands from %q", len(found), path)
+			}
+			commands = mergeCompileCommands(commands, found)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
 	return writeCompileCommands(jsonFilename, commands)
 }
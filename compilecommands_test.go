@@ -0,0 +1,65 @@
+// dcc - dependency-driven C/C++ compiler front end
+//
+// Copyright © A.Newman 2015.
+//
+// This source code is released under version 2 of the  GNU Public License.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeCompileCommands(t *testing.T) {
+	existing := []CompileCommand{
+		{Directory: "/src", Command: "cc -c a.c", File: "a.c", Output: "a.o"},
+		{Directory: "/src", Arguments: []string{"cc", "-c", "b.c"}, File: "/src/b.c", Output: "b.o"},
+	}
+	updates := []CompileCommand{
+		{Directory: "/src", Arguments: []string{"cc", "-O", "-c", "a.c"}, File: "/src/a.c", Output: "a.o"},
+		{Directory: "/src", Arguments: []string{"cc", "-c", "c.c"}, File: "/src/c.c", Output: "c.o"},
+	}
+	expected := []CompileCommand{updates[0], existing[1], updates[1]}
+
+	actual := mergeCompileCommands(existing, updates)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("got %v, expected %v", actual, expected)
+	}
+}
+
+func TestMergeCompileCommandsWithoutOutput(t *testing.T) {
+	existing := []CompileCommand{
+		{Directory: "/src", Command: "cc -c a.c", File: "a.c"},
+		{Directory: "/src", Command: "cc -c b.c", File: "b.c"},
+	}
+	updates := []CompileCommand{
+		{Directory: "/src", Arguments: []string{"cc", "-c", "a.c", "-o", "a.o"}, File: "/src/a.c", Output: "a.o"},
+		{Directory: "/src", Arguments: []string{"cc", "-O", "-c", "a.c", "-o", "a.o"}, File: "/src/a.c", Output: "a.o"},
+		{Directory: "/src", Arguments: []string{"cc", "-c", "c.c", "-o", "c.o"}, File: "/src/c.c", Output: "c.o"},
+	}
+	expected := []CompileCommand{updates[1], existing[1], updates[2]}
+
+	actual := mergeCompileCommands(existing, updates)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("got %v, expected %v", actual, expected)
+	}
+}
+
+func TestCompileCommand(t *testing.T) {
+	options := []string{"-O", "-Iinclude"}
+
+	gcc := NewGccStyleCompiler("cc")
+	expected := []string{"cc", "-O", "-Iinclude", "-c", "a.c", "-o", ".dcc/a.o"}
+	if actual := gcc.CompileCommand("a.c", ".dcc/a.o", options); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("gcc: got %q, expected %q", actual, expected)
+	}
+
+	cl := NewMsvcCompiler()
+	expected = []string{"cl", "-O", "-Iinclude", "/nologo", "/c", "a.c", "/Fo.dcc/a.o"}
+	if actual := cl.CompileCommand("a.c", ".dcc/a.o", options); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("cl: got %q, expected %q", actual, expected)
+	}
+}
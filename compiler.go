@@ -10,7 +10,8 @@ package main
 
 import (
 	"io"
-	"log"
+	"os/exec"
+	"path/filepath"
 	"strings"
 )
 
@@ -32,6 +33,14 @@ type Compiler interface {
 	//
 	Compile(source, object, deps string, options []string, w io.Writer) error
 
+	// Return the command line, the command name followed by its
+	// arguments, run to compile the source file named by source
+	// to create an object file named object. The options used to
+	// generate dependencies, or control the appearance of the
+	// compiler's output, are not included.
+	//
+	CompileCommand(source, object string, options []string) []string
+
 	// Read a compiler-generated depdencies file and return the dependent filenames.
 	//
 	ReadDependencies(path string) (string, []string, error)
@@ -39,6 +48,15 @@ type Compiler interface {
 	// Return the command line options used to name the ouput executable
 	// file when the compiler (driver) is used to link a program
 	DefineExecutableArgs(exeName string) []string
+
+	// Return the directories the compiler searches for system
+	// header files.
+	//
+	SystemIncludeDirs() ([]string, error)
+
+	// Return the compiler's version number, e.g. 12.2.0.
+	//
+	Version() (string, error)
 }
 
 // GetCompiler is a factory function to return a value that implements
@@ -57,6 +75,42 @@ func GetCompiler(name string) Compiler {
 			return NewGccStyleCompiler(name)
 		}
 	}
-	log.Fatalf("%s: unsupported compiler", name)
+	Fatalf("%s: unsupported compiler", name)
 	return nil
 }
+
+// Compiler families. Options files may be specific to a family of
+// compilers, e.g. CFLAGS.clang, as warning options and the like
+// differ between families.
+//
+const (
+	GccFamily   = "gcc"
+	ClangFamily = "clang"
+	IntelFamily = "icc"
+	MsvcFamily  = "msvc"
+)
+
+// GetCompilerFamily returns the family of the named compiler. The
+// generic names, cc and c++, are usually links to the actual
+// compiler which we follow if we can. If we can't we assume the
+// compiler is the platform's default.
+//
+func GetCompilerFamily(name string) string {
+	base := strings.ToLower(strings.TrimSuffix(filepath.Base(name), ".exe"))
+	switch {
+	case base == "cl":
+		return MsvcFamily
+	case strings.Contains(base, "clang"):
+		return ClangFamily
+	case strings.Contains(base, "gcc"), strings.Contains(base, "g++"):
+		return GccFamily
+	case strings.HasPrefix(base, "icc"), strings.HasPrefix(base, "icpc"), strings.HasPrefix(base, "icx"):
+		return IntelFamily
+	}
+	if path, err := exec.LookPath(name); err == nil {
+		if actual, err := filepath.EvalSymlinks(path); err == nil && filepath.Base(actual) != filepath.Base(path) {
+			return GetCompilerFamily(actual)
+		}
+	}
+	return platform.DefaultFamily
+}
@@ -10,70 +10,156 @@ package main
 
 import "errors"
 
+// ScanState is the state of a single conditional section.
+//
 type ScanState int
 
 const (
-	TrueConditionState ScanState = iota
-	FalseConditionState
-	InElseState
+	TrueConditionState  ScanState = iota // in the branch being used
+	FalseConditionState                  // no branch used yet
+	DoneConditionState                   // a previous branch was used
+	SkippedState                         // the entire section is being skipped
+)
+
+var (
+	ErrNoCondition   = errors.New("not within a conditional section")
+	ErrElseAfterElse = errors.New("!else after !else")
+	ErrElifAfterElse = errors.New("!elif after !else")
 )
 
-var ErrNoCondition = errors.New("not within a conditional section")
+// conditionalSection records the state of a single, possibly nested,
+// conditional section.
+//
+type conditionalSection struct {
+	state    ScanState
+	seenElse bool
+	line     int // the line number of the section's opening directive
+}
 
+// Conditional tracks the nested conditional sections of an options
+// file and determines if lines are to be used or skipped.
+//
+// A section nested within a section, or branch, being skipped is
+// skipped in its entirety, none of its branches are used regardless
+// of their conditions.
+//
 type Conditional struct {
-	states []ScanState
+	sections []conditionalSection
 }
 
+// IsActive returns true if the receiver is within a conditional
+// section.
+//
 func (c *Conditional) IsActive() bool {
-	return len(c.states) > 0
+	return len(c.sections) > 0
 }
 
-func (c *Conditional) PushState(state ScanState) {
-	c.states = append(c.states, state)
+// IsNested returns true if the receiver is within a conditional
+// section that is itself within a conditional section.
+//
+func (c *Conditional) IsNested() bool {
+	return len(c.sections) > 1
 }
 
-func (c *Conditional) PopState() error {
-	if len(c.states) == 0 {
-		return ErrNoCondition
-	}
-	c.states = c.states[:len(c.states)-1]
-	return nil
+// CurrentState returns the state of the innermost conditional
+// section.
+//
+func (c *Conditional) CurrentState() ScanState {
+	return c.current().state
 }
 
-func (c *Conditional) SetState(state ScanState) {
-	c.states[len(c.states)-1] = state
+// StartLine returns the line number of the innermost conditional
+// section's opening directive.
+//
+func (c *Conditional) StartLine() int {
+	return c.current().line
 }
 
-func (c *Conditional) CurrentState() ScanState {
-	return c.states[len(c.states)-1]
+func (c *Conditional) current() *conditionalSection {
+	return &c.sections[len(c.sections)-1]
 }
 
+// IsSkippingLines returns true if lines are currently being skipped.
+//
 func (c *Conditional) IsSkippingLines() bool {
+	return c.IsActive() && c.CurrentState() != TrueConditionState
+}
+
+// If starts a new conditional section, e.g. !ifdef or !if, whose
+// first branch is used if the condition is true.
+//
+func (c *Conditional) If(condition bool, line int) {
+	state := FalseConditionState
+	switch {
+	case c.IsSkippingLines():
+		state = SkippedState
+	case condition:
+		state = TrueConditionState
+	}
+	c.sections = append(c.sections, conditionalSection{state: state, line: line})
+}
+
+// Elif starts a new branch, used if the condition is true and no
+// previous branch of the section was used.
+//
+func (c *Conditional) Elif(condition bool) error {
 	if !c.IsActive() {
-		return false
+		return ErrNoCondition
+	}
+	section := c.current()
+	if section.seenElse {
+		return ErrElifAfterElse
 	}
-	if c.CurrentState() == TrueConditionState {
-		return false
+	switch section.state {
+	case TrueConditionState:
+		section.state = DoneConditionState
+	case FalseConditionState:
+		if condition {
+			section.state = TrueConditionState
+		}
 	}
-	return true
+	return nil
 }
 
-func (c *Conditional) IsNested() bool {
-	return len(c.states) > 1
+// Else starts the final branch of a section, used if no previous
+// branch of the section was used.
+//
+func (c *Conditional) Else() error {
+	if !c.IsActive() {
+		return ErrNoCondition
+	}
+	section := c.current()
+	if section.seenElse {
+		return ErrElseAfterElse
+	}
+	section.seenElse = true
+	switch section.state {
+	case TrueConditionState:
+		section.state = DoneConditionState
+	case FalseConditionState:
+		section.state = TrueConditionState
+	}
+	return nil
 }
 
-func (c *Conditional) SkipLine(line string) bool {
-	if c.CurrentState() == TrueConditionState {
-		return false
+// Endif ends the innermost conditional section.
+//
+func (c *Conditional) Endif() error {
+	if !c.IsActive() {
+		return ErrNoCondition
 	}
-	return false
+	c.sections = c.sections[:len(c.sections)-1]
+	return nil
 }
 
-func (c *Conditional) ToggleState() {
-	switch c.CurrentState() {
-	case TrueConditionState:
-		c.SetState(FalseConditionState)
-	case FalseConditionState:
-		c.SetState(TrueConditionState)
+// NeedsCondition returns true if the condition of a branch starting
+// now would be used. Conditions are not evaluated when they aren't
+// needed so errors, e.g. in an expression, within skipped sections
+// are not reported.
+//
+func (c *Conditional) NeedsCondition(elif bool) bool {
+	if !elif {
+		return !c.IsSkippingLines()
 	}
+	return c.IsActive() && c.CurrentState() == FalseConditionState
 }
@@ -0,0 +1,198 @@
+// dcc - dependency-driven C/C++ compiler front end
+//
+// Copyright © A.Newman 2015.
+//
+// This source code is released under version 2 of the  GNU Public License.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Early cutoff.
+//
+// A change to a header file that doesn't alter the generated code,
+// e.g. editing a comment, causes every dependent source file to be
+// re-compiled and, because the object files are then newer than the
+// executable or library, everything to be re-linked. Ninja avoids
+// the second part of that with its "restat" rules and dcc does
+// something similar.
+//
+// After compiling a file dcc records a hash of the object file's
+// content alongside its dependency file in what we call an object
+// "stamp". The stamp also records the time the object's content
+// last changed. If a re-compilation produces an object identical
+// to the previous one the stamp's change time is carried forward.
+// Linking (and archiving) use the change time, not the object's
+// modtime, when deciding if an output is out of date.
+//
+// The object file's modtime is left alone so the object remains up
+// to date with respect to the header that caused it to be rebuilt.
+//
+
+// ObjectStamp records the hash of an object file's content, the
+// object's modtime when the hash was computed and the time the
+// content last changed.
+//
+type ObjectStamp struct {
+	Hash    string
+	ModTime time.Time
+	Changed time.Time
+}
+
+// ObjectState is the state of an object file prior to it being
+// re-compiled. It is used to determine if re-compilation actually
+// changed anything.
+//
+type ObjectState struct {
+	Hash    string
+	Changed time.Time
+}
+
+// StampFilename returns the name of the stamp file for a given object file.
+//
+func StampFilename(ofile string) string {
+	return strings.TrimSuffix(DepsFilename(ofile), ".d") + ".hash"
+}
+
+// IsObjectFile returns true if the supplied pathname is that of an
+// object file on the host platform.
+//
+func IsObjectFile(path string) bool {
+	return filepath.Ext(path) == platform.ObjectFileSuffix
+}
+
+// ReadObjectStamp reads the stamp file for the named object file.
+//
+func ReadObjectStamp(ofile string) (*ObjectStamp, error) {
+	data, err := ioutil.ReadFile(StampFilename(ofile))
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("%s: malformed object stamp", StampFilename(ofile))
+	}
+	mtime, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	changed, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectStamp{
+		Hash:    fields[0],
+		ModTime: time.Unix(0, mtime),
+		Changed: time.Unix(0, changed),
+	}, nil
+}
+
+// WriteObjectStamp writes the stamp file for the named object file.
+//
+func WriteObjectStamp(ofile string, stamp *ObjectStamp) error {
+	s := fmt.Sprintf("%s %d %d\n", stamp.Hash, stamp.ModTime.UnixNano(), stamp.Changed.UnixNano())
+	return ioutil.WriteFile(StampFilename(ofile), []byte(s), 0666)
+}
+
+// HashFile returns the hex-encoded SHA-256 hash of a file's content.
+//
+func HashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// PreviousObjectState returns the state of an existing object file
+// prior to its re-compilation. A nil return means there is no
+// existing object file, or it could not be hashed, and early cutoff
+// is not possible.
+//
+func PreviousObjectState(ofile string) *ObjectState {
+	info, err := os.Stat(ofile)
+	if err != nil {
+		return nil
+	}
+	hash, err := HashFile(ofile)
+	if err != nil {
+		return nil
+	}
+	return &ObjectState{
+		Hash:    hash,
+		Changed: ObjectModTime(ofile, info),
+	}
+}
+
+// RecordObjectState writes the stamp for a newly compiled object
+// file. If the object's content is unchanged from the previous state
+// its previous change time is retained. RecordObjectState returns
+// true if the object's content was unchanged.
+//
+func RecordObjectState(ofile string, prev *ObjectState) (bool, error) {
+	ClearCachedStat(ofile)
+	info, err := Stat(ofile)
+	if err != nil {
+		return false, err
+	}
+	hash, err := HashFile(ofile)
+	if err != nil {
+		return false, err
+	}
+	stamp := &ObjectStamp{
+		Hash:    hash,
+		ModTime: info.ModTime(),
+		Changed: info.ModTime(),
+	}
+	unchanged := prev != nil && prev.Hash == hash
+	if unchanged {
+		stamp.Changed = prev.Changed
+	}
+	return unchanged, WriteObjectStamp(ofile, stamp)
+}
+
+// ObjectModTime returns the time an object file's content last
+// changed. This is the change time recorded in the object's stamp,
+// if it has a valid stamp, otherwise the object's modtime.
+//
+// A stamp is only valid if it was made for the object file as it
+// currently exists, i.e. the object has not been modified since
+// the stamp was written.
+//
+func ObjectModTime(ofile string, info os.FileInfo) time.Time {
+	stamp, err := ReadObjectStamp(ofile)
+	if err != nil || !stamp.ModTime.Equal(info.ModTime()) {
+		return info.ModTime()
+	}
+	return stamp.Changed
+}
+
+// EffectiveModTime returns the modification time dcc uses for a
+// file when determining if outputs are out of date. For object files
+// this is the time their content last changed, for everything else
+// it is simply the file's modtime.
+//
+func EffectiveModTime(path string, info os.FileInfo) time.Time {
+	if IsObjectFile(path) {
+		return ObjectModTime(path, info)
+	}
+	return info.ModTime()
+}
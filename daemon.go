@@ -0,0 +1,557 @@
+// dcc - dependency-driven C/C++ compiler front end
+//
+// Copyright © A.Newman 2015.
+//
+// This source code is released under version 2 of the  GNU Public License.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The dcc daemon.
+//
+// When make runs dcc once per source file each dcc process starts
+// from scratch, re-reading .d files and re-stat'ing the same header
+// files as every other dcc process. The daemon is a long running,
+// per-user, process that keeps the results of this work. dcc
+// processes ask the daemon for the dependencies of an object file and
+// for the modtimes of those dependencies. The daemon watches the
+// directories containing the files it knows about (see watcher.go)
+// and forgets what it knows about a file when the file changes.
+//
+// The daemon keeps file information, from stat, and the content of
+// .d files.
+//
+// Changes are reported to the daemon asynchronously. A file changed
+// immediately before running dcc may not yet have been reported so
+// each dcc process first asks the daemon to sync, to wait until it
+// has seen all changes made before the request, before it asks about
+// any files.
+//
+// The daemon is optional. If dcc can't talk to a daemon it does the
+// work itself, as it always has.
+//
+// dcc and the daemon communicate via a UNIX domain socket using
+// a simple JSON-encoded request/response protocol. The socket is
+// only accessible by the user and dcc only uses a socket owned by
+// the user (see daemon_unix.go).
+//
+
+// DaemonSocketPath returns the pathname of the daemon's socket. This
+// is the value of the DCCDAEMON environment variable or dcc.sock in
+// the user's runtime directory, $XDG_RUNTIME_DIR, or, if that is not
+// set, in a per-user directory within the system's temporary
+// directory.
+//
+func DaemonSocketPath() string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), fmt.Sprintf("dcc-%d", os.Getuid()))
+	}
+	return Getenv("DCCDAEMON", filepath.Join(dir, "dcc.sock"))
+}
+
+const (
+	daemonOpDeps = "deps" // return an object file's dependencies
+	daemonOpStat = "stat" // return file information
+	daemonOpSync = "sync" // wait for changes to be seen
+)
+
+type daemonRequest struct {
+	Op       string   `json:"op"`
+	Compiler string   `json:"compiler,omitempty"`
+	Depsfile string   `json:"depsfile,omitempty"`
+	Paths    []string `json:"paths,omitempty"`
+}
+
+type daemonResponse struct {
+	Target   string           `json:"target,omitempty"`
+	Deps     []string         `json:"deps,omitempty"`
+	Files    []daemonFileInfo `json:"files,omitempty"`
+	NotExist bool             `json:"notexist,omitempty"`
+	Error    string           `json:"error,omitempty"`
+}
+
+// daemonFileInfo is the information about a file returned by the
+// daemon, a subset of an os.FileInfo.
+//
+type daemonFileInfo struct {
+	ModTime  int64  `json:"mtime"`
+	Size     int64  `json:"size"`
+	IsDir    bool   `json:"dir,omitempty"`
+	NotExist bool   `json:"notexist,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ----------------------------------------------------------------
+// The daemon
+//
+
+type daemon struct {
+	watcher *Watcher
+	mutex   sync.Mutex
+	epoch   uint64 // incremented upon every file change
+	stats   map[string]daemonFileInfo
+	deps    map[string]*daemonDeps // keyed by .d file name
+	syncs   chan chan struct{}
+}
+
+// daemonDeps is the cached content of a .d file. As with the
+// dependency database (depsdb.go) entries are validated using the .d
+// file's modtime and size.
+//
+type daemonDeps struct {
+	modtime time.Time
+	size    int64
+	target  string
+	deps    []string
+}
+
+// RunDaemon runs the dcc daemon, listening for requests on the named
+// socket. RunDaemon only returns if the daemon fails to start or is
+// interrupted.
+//
+func RunDaemon(socketPath string) error {
+	dir := filepath.Dir(socketPath)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := checkDaemonDir(dir); err != nil {
+		return err
+	}
+	if conn, err := net.Dial("unix", socketPath); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s: a daemon is already running", socketPath)
+	}
+	os.Remove(socketPath) // stale socket
+
+	watcher, err := NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return err
+	}
+
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupted
+		listener.Close()
+	}()
+
+	d := &daemon{
+		watcher: watcher,
+		stats:   make(map[string]daemonFileInfo),
+		deps:    make(map[string]*daemonDeps),
+		syncs:   make(chan chan struct{}),
+	}
+	go d.invalidate()
+
+	if !Quiet {
+		log.Printf("daemon listening on %s", socketPath)
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			os.Remove(socketPath)
+			return nil
+		}
+		go d.serve(conn)
+	}
+}
+
+// invalidate forgets what the receiver knows about files as they
+// change.
+//
+func (d *daemon) invalidate() {
+	for {
+		select {
+		case path, ok := <-d.watcher.Events:
+			if !ok {
+				return
+			}
+			d.forget(path)
+		case done := <-d.syncs:
+			for n := len(d.watcher.Events); n > 0; n-- {
+				d.forget(<-d.watcher.Events)
+			}
+			close(done)
+		}
+	}
+}
+
+// forget forgets what the receiver knows about a changed file. The
+// watcher sends an empty path if it has lost changes, and the path of
+// a directory, ending in a separator, if the directory itself was
+// replaced (see watcher.go). Either way everything that may have
+// changed is forgotten.
+//
+func (d *daemon) forget(path string) {
+	d.mutex.Lock()
+	switch {
+	case path == "":
+		d.stats = make(map[string]daemonFileInfo)
+		d.deps = make(map[string]*daemonDeps)
+	case strings.HasSuffix(path, string(filepath.Separator)):
+		delete(d.stats, filepath.Clean(path))
+		for name := range d.stats {
+			if strings.HasPrefix(name, path) {
+				delete(d.stats, name)
+			}
+		}
+		for name := range d.deps {
+			if strings.HasPrefix(name, path) {
+				delete(d.deps, name)
+			}
+		}
+	default:
+		delete(d.stats, path)
+	}
+	d.epoch++
+	d.mutex.Unlock()
+	if Debug {
+		log.Printf("DAEMON: %q changed", path)
+	}
+}
+
+// sync waits until the receiver has forgotten about any files changed
+// before sync was called. The watcher sends the changes it has seen
+// on its Events channel and invalidate then processes those it has
+// not yet read.
+//
+func (d *daemon) sync() error {
+	if err := d.watcher.Sync(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	d.syncs <- done
+	<-done
+	return nil
+}
+
+// serve handles the requests made on a single connection.
+//
+func (d *daemon) serve(conn net.Conn) {
+	defer conn.Close()
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+	for {
+		var req daemonRequest
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		var resp daemonResponse
+		switch req.Op {
+		case daemonOpDeps:
+			d.dependencies(&req, &resp)
+		case daemonOpStat:
+			resp.Files = make([]daemonFileInfo, len(req.Paths))
+			for index, path := range req.Paths {
+				resp.Files[index] = d.stat(path)
+			}
+		case daemonOpSync:
+			if err := d.sync(); err != nil {
+				resp.Error = err.Error()
+			}
+		default:
+			resp.Error = fmt.Sprintf("%q: unknown request", req.Op)
+		}
+		if err := enc.Encode(&resp); err != nil {
+			return
+		}
+	}
+}
+
+// stat returns information about a file, from the cache if possible.
+//
+// The file is watched before it is stat'd so no change can be missed.
+// The result is only cached if no files changed while the file was
+// being stat'd, otherwise we can't know if the result is current.
+// Results are not cached if the file's directory can't be watched.
+//
+func (d *daemon) stat(path string) daemonFileInfo {
+	d.mutex.Lock()
+	if info, found := d.stats[path]; found {
+		d.mutex.Unlock()
+		return info
+	}
+	epoch := d.epoch
+	d.mutex.Unlock()
+
+	watching := d.watcher.Add(path) == nil
+
+	var result daemonFileInfo
+	info, err := os.Stat(path)
+	switch {
+	case os.IsNotExist(err):
+		result.NotExist = true
+	case err != nil:
+		result.Error = err.Error()
+	default:
+		result.ModTime = info.ModTime().UnixNano()
+		result.Size = info.Size()
+		result.IsDir = info.IsDir()
+	}
+
+	if watching && result.Error == "" {
+		d.mutex.Lock()
+		if d.epoch == epoch {
+			d.stats[path] = result
+		}
+		d.mutex.Unlock()
+	}
+	return result
+}
+
+// dependencies reads the .d file named in the request, using any
+// cached content if the file has not changed.
+//
+func (d *daemon) dependencies(req *daemonRequest, resp *daemonResponse) {
+	info, err := os.Stat(req.Depsfile)
+	if os.IsNotExist(err) {
+		resp.NotExist = true
+		return
+	}
+	if err != nil {
+		resp.Error = err.Error()
+		return
+	}
+	d.mutex.Lock()
+	cached, found := d.deps[req.Depsfile]
+	d.mutex.Unlock()
+	if found && cached.modtime.Equal(info.ModTime()) && cached.size == info.Size() {
+		resp.Target, resp.Deps = cached.target, cached.deps
+		return
+	}
+	target, deps, err := GetCompiler(req.Compiler).ReadDependencies(req.Depsfile)
+	if err != nil {
+		resp.Error = err.Error()
+		return
+	}
+	d.mutex.Lock()
+	d.deps[req.Depsfile] = &daemonDeps{
+		modtime: info.ModTime(),
+		size:    info.Size(),
+		target:  target,
+		deps:    deps,
+	}
+	d.mutex.Unlock()
+	resp.Target, resp.Deps = target, deps
+}
+
+// ----------------------------------------------------------------
+// The client
+//
+
+// DaemonClient is used to make requests of a daemon. A DaemonClient
+// may be used concurrently, each concurrent request uses its own
+// connection to the daemon.
+//
+type DaemonClient struct {
+	path  string
+	conns chan *daemonConn // idle connections
+}
+
+type daemonConn struct {
+	conn net.Conn
+	enc  *json.Encoder
+	dec  *json.Decoder
+}
+
+// ErrDaemon is returned when a daemon request fails.
+//
+var ErrDaemon = errors.New("daemon request failed")
+
+// ConnectDaemon returns a DaemonClient for the daemon listening on
+// the named socket or nil if no daemon is listening, or the socket
+// can't be trusted. The daemon is synced so it has seen any changes
+// made before ConnectDaemon was called.
+//
+func ConnectDaemon(socketPath string) *DaemonClient {
+	if err := checkDaemonSocket(socketPath); err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("warning: not using the daemon: %s", err)
+		} else if Debug {
+			log.Printf("DAEMON: %s", err)
+		}
+		return nil
+	}
+	c := &DaemonClient{
+		path:  socketPath,
+		conns: make(chan *daemonConn, NumJobs),
+	}
+	conn, err := c.dial()
+	if err != nil {
+		if Debug {
+			log.Printf("DAEMON: %s", err)
+		}
+		return nil
+	}
+	c.release(conn)
+	var resp daemonResponse
+	err = c.call(&daemonRequest{Op: daemonOpSync}, &resp)
+	if err == nil && resp.Error != "" {
+		err = errors.New(resp.Error)
+	}
+	if err != nil {
+		log.Printf("warning: not using the daemon: %s", err)
+		return nil
+	}
+	if Debug {
+		log.Printf("DAEMON: connected to %q", socketPath)
+	}
+	return c
+}
+
+func (c *DaemonClient) dial() (*daemonConn, error) {
+	conn, err := net.Dial("unix", c.path)
+	if err != nil {
+		return nil, err
+	}
+	return &daemonConn{conn, json.NewEncoder(conn), json.NewDecoder(conn)}, nil
+}
+
+func (c *DaemonClient) release(conn *daemonConn) {
+	select {
+	case c.conns <- conn:
+	default:
+		conn.conn.Close()
+	}
+}
+
+// call makes a request of the daemon and awaits its response.
+//
+func (c *DaemonClient) call(req *daemonRequest, resp *daemonResponse) error {
+	var conn *daemonConn
+	select {
+	case conn = <-c.conns:
+	default:
+		var err error
+		if conn, err = c.dial(); err != nil {
+			return err
+		}
+	}
+	if err := conn.enc.Encode(req); err != nil {
+		conn.conn.Close()
+		return err
+	}
+	if err := conn.dec.Decode(resp); err != nil {
+		conn.conn.Close()
+		return err
+	}
+	c.release(conn)
+	return nil
+}
+
+// Dependencies returns the target and dependencies defined by a .d
+// file. Like the Compiler's ReadDependencies a missing .d file
+// results in an error satisfying os.IsNotExist. Failure to talk
+// to the daemon results in ErrDaemon.
+//
+func (c *DaemonClient) Dependencies(depsfile string) (string, []string, error) {
+	req := daemonRequest{
+		Op:       daemonOpDeps,
+		Compiler: ActualCompiler.Name(),
+		Depsfile: absPath(depsfile),
+	}
+	var resp daemonResponse
+	if err := c.call(&req, &resp); err != nil {
+		if Debug {
+			log.Printf("DAEMON: %s", err)
+		}
+		return "", nil, ErrDaemon
+	}
+	switch {
+	case resp.NotExist:
+		return "", nil, &os.PathError{Op: "open", Path: depsfile, Err: os.ErrNotExist}
+	case resp.Error != "":
+		return "", nil, errors.New(resp.Error)
+	}
+	return resp.Target, resp.Deps, nil
+}
+
+// StatAll returns the os.FileInfo, or error, for each of the named
+// files. Failure to talk to the daemon results in ErrDaemon.
+//
+func (c *DaemonClient) StatAll(paths []string) ([]os.FileInfo, []error, error) {
+	req := daemonRequest{
+		Op:    daemonOpStat,
+		Paths: make([]string, len(paths)),
+	}
+	for index, path := range paths {
+		req.Paths[index] = absPath(path)
+	}
+	var resp daemonResponse
+	if err := c.call(&req, &resp); err != nil || len(resp.Files) != len(paths) {
+		if Debug {
+			log.Printf("DAEMON: %v", err)
+		}
+		return nil, nil, ErrDaemon
+	}
+	infos := make([]os.FileInfo, len(paths))
+	errs := make([]error, len(paths))
+	for index, file := range resp.Files {
+		switch {
+		case file.NotExist:
+			errs[index] = &os.PathError{Op: "stat", Path: paths[index], Err: os.ErrNotExist}
+		case file.Error != "":
+			errs[index] = errors.New(file.Error)
+		default:
+			infos[index] = &daemonStat{filepath.Base(paths[index]), file}
+		}
+	}
+	return infos, errs, nil
+}
+
+// daemonStat adapts a daemonFileInfo to the os.FileInfo interface.
+//
+type daemonStat struct {
+	name string
+	info daemonFileInfo
+}
+
+func (s *daemonStat) Name() string       { return s.name }
+func (s *daemonStat) Size() int64        { return s.info.Size }
+func (s *daemonStat) ModTime() time.Time { return time.Unix(0, s.info.ModTime) }
+func (s *daemonStat) IsDir() bool        { return s.info.IsDir }
+func (s *daemonStat) Sys() interface{}   { return nil }
+
+func (s *daemonStat) Mode() os.FileMode {
+	if s.info.IsDir {
+		return os.ModeDir
+	}
+	return 0
+}
+
+// absPath returns the absolute form of a path relative to dcc's
+// working directory. The daemon has its own working directory.
+//
+func absPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(DccCurrentDirectory, path)
+}
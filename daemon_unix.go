@@ -0,0 +1,61 @@
+// dcc - dependency-driven C/C++ compiler front end
+//
+// Copyright © A.Newman 2015.
+//
+// This source code is released under version 2 of the  GNU Public License.
+// See the file LICENSE for details.
+//
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// checkDaemonDir returns an error if the directory containing the
+// daemon's socket is not owned by the user, or root, or may be
+// written by others without the sticky bit being set, i.e. if
+// another user could create, or replace, the socket.
+//
+func checkDaemonDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Getuid() && stat.Uid != 0 {
+		return fmt.Errorf("%s: not owned by the current user", dir)
+	}
+	if info.Mode().Perm()&0022 != 0 && info.Mode()&os.ModeSticky == 0 {
+		return fmt.Errorf("%s: writable by other users", dir)
+	}
+	return nil
+}
+
+// checkDaemonSocket returns an error if the daemon's socket is not a
+// socket created by the user in a directory checked by
+// checkDaemonDir. The daemon is trusted to report dependencies and
+// file information and a daemon run by another user could otherwise
+// have dcc skip compiles or learn about the user's files.
+//
+func checkDaemonSocket(socketPath string) error {
+	if err := checkDaemonDir(filepath.Dir(socketPath)); err != nil {
+		return err
+	}
+	info, err := os.Lstat(socketPath)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s: not a socket", socketPath)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("%s: not owned by the current user", socketPath)
+	}
+	return nil
+}
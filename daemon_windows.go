@@ -0,0 +1,23 @@
+// dcc - dependency-driven C/C++ compiler front end
+//
+// Copyright © A.Newman 2015.
+//
+// This source code is released under version 2 of the  GNU Public License.
+// See the file LICENSE for details.
+//
+
+package main
+
+// checkDaemonDir checks the directory containing the daemon's socket.
+// Windows has no file owner in an os.FileInfo and the directory, in
+// the user's profile, is private to the user.
+//
+func checkDaemonDir(dir string) error {
+	return nil
+}
+
+// checkDaemonSocket checks the daemon's socket, see checkDaemonDir.
+//
+func checkDaemonSocket(socketPath string) error {
+	return nil
+}
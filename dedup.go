@@ -0,0 +1,106 @@
+// dcc - dependency-driven C/C++ compiler front end
+//
+// Copyright © A.Newman 2015.
+//
+// This source code is released under version 2 of the  GNU Public License.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"sync"
+)
+
+// Diagnostic de-duplication.
+//
+// A warning in a header file is output by the compiler for every
+// source file that includes the header. With --dedup-diagnostics dcc
+// outputs each such diagnostic once, the first time it is seen, and
+// at the end of the build lists those diagnostics reported by more
+// than one source with a count of the sources affected.
+//
+// Compiler output is split into groups, each a diagnostic and the
+// lines that go with it, the "In file included from" lines before it
+// and the source excerpt and notes that follow it. A group whose
+// diagnostic has already been output is dropped.
+//
+
+// DiagnosticDeduper filters compiler output to remove diagnostics
+// already output. A DiagnosticDeduper may be used concurrently.
+//
+type DiagnosticDeduper struct {
+	mutex   sync.Mutex
+	counts  map[Diagnostic]int
+	ordered []Diagnostic
+}
+
+// Lines of gcc and clang output that provide the context for the
+// diagnostic that follows them.
+//
+var diagnosticContext = regexp.MustCompile(`^(In file included from |\s+from .*[:,]$|.*: (In|At) .*:$|In member function |In instantiation of )`)
+
+// NewDiagnosticDeduper returns a new DiagnosticDeduper.
+//
+func NewDiagnosticDeduper() *DiagnosticDeduper {
+	return &DiagnosticDeduper{counts: make(map[Diagnostic]int)}
+}
+
+// Filter returns a single source's compiler output less any
+// diagnostics previously output.
+//
+func (dd *DiagnosticDeduper) Filter(output []byte) []byte {
+	dd.mutex.Lock()
+	defer dd.mutex.Unlock()
+
+	var result, context bytes.Buffer
+	seen := make(map[Diagnostic]bool)
+	dropping := false
+	for _, line := range bytes.SplitAfter(output, []byte("\n")) {
+		text := string(bytes.TrimRight(StripEscapes(line), "\r\n"))
+		d, isDiagnostic := ParseDiagnostic(text)
+		switch {
+		case isDiagnostic && !d.IsNote():
+			dropping = dd.counts[d] > 0
+			if !seen[d] {
+				seen[d] = true
+				if dd.counts[d] == 0 {
+					dd.ordered = append(dd.ordered, d)
+				}
+				dd.counts[d]++
+			}
+			if !dropping {
+				result.Write(context.Bytes())
+				result.Write(line)
+			}
+			context.Reset()
+		case !isDiagnostic && diagnosticContext.MatchString(text):
+			context.Write(line)
+		default:
+			if !dropping {
+				result.Write(context.Bytes())
+				result.Write(line)
+			}
+			context.Reset()
+		}
+	}
+	result.Write(context.Bytes())
+	return result.Bytes()
+}
+
+// Report writes the diagnostics reported by more than one source,
+// and the number of sources, to the given io.Writer.
+//
+func (dd *DiagnosticDeduper) Report(w io.Writer) {
+	dd.mutex.Lock()
+	defer dd.mutex.Unlock()
+	for _, d := range dd.ordered {
+		if n := dd.counts[d]; n > 1 {
+			fmt.Fprintf(w, "%s (reported by %d sources)\n", d.String(), n)
+		}
+	}
+}
@@ -0,0 +1,421 @@
+// dcc - dependency-driven C/C++ compiler front end
+//
+// Copyright © A.Newman 2015.
+//
+// This source code is released under version 2 of the  GNU Public License.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DepsDatabaseFilename is the name of the dependency database file
+// kept in the dependency file directory of an object directory.
+//
+const DepsDatabaseFilename = "deps.db"
+
+// The dependency database file format version. Files with a
+// different version are ignored and re-created.
+//
+const depsDatabaseVersion = 1
+
+var (
+	depsDatabaseMagic = []byte("dccdeps\x00")
+
+	// ErrBadDepsDatabase means the dependency database file
+	// is corrupt or of the wrong version.
+	ErrBadDepsDatabase = errors.New("malformed dependency database")
+)
+
+// DepsDatabase is a compact, binary, store of the dependencies of the
+// object files in an object directory. It is loaded once, when dcc
+// starts compiling, and avoids reading and tokenizing a .d file for
+// every object file on every run (similar to ninja's .ninja_deps).
+//
+// The .d files written by the compiler remain the source of truth.
+// Each database entry records the modtime and size of the .d file it
+// was made from and an entry is only used if the .d file is unchanged.
+// Otherwise the .d file is parsed, as before, and the result added to
+// the database.
+//
+// On disk the database is a table of unique path names followed by
+// the entries, which refer to paths by their index in the table. Most
+// objects depend upon the same headers so this is considerably more
+// compact than the text files. The file ends with a CRC of its content
+// and a corrupt database is discarded (and re-created from the .d
+// files). An entry whose .d file is found to no longer exist is
+// dropped when the database is written.
+//
+// Many dcc processes, e.g. those run by make -j, may update the same
+// database. Each process only writes the entries it changed, merging
+// them with the current content of the file while holding its lock
+// file.
+//
+type DepsDatabase struct {
+	path    string
+	mutex   sync.Mutex
+	entries map[string]*depsEntry // keyed by object filename
+	strings map[string]string     // interned path names
+	touched map[string]bool       // objects whose entries were changed, or removed, by this process
+	dirty   bool
+}
+
+// depsEntry is the dependency information for a single object file.
+//
+type depsEntry struct {
+	depsfile string    // the .d file the entry was made from
+	modtime  time.Time // .d file modtime
+	size     int64     // .d file size
+	target   string    // target named in the .d file
+	deps     []string  // dependent files
+}
+
+// DepsDatabasePath returns the pathname of the dependency database
+// for an object directory.
+//
+func DepsDatabasePath(objdir string) string {
+	return filepath.Join(objdir, DepsDir, DepsDatabaseFilename)
+}
+
+// LoadDepsDatabase loads the dependency database file at the given
+// path. A missing or corrupt file results in an empty database.
+//
+func LoadDepsDatabase(path string) *DepsDatabase {
+	db := &DepsDatabase{
+		path:    path,
+		entries: make(map[string]*depsEntry),
+		strings: make(map[string]string),
+		touched: make(map[string]bool),
+	}
+	entries, err := db.read()
+	switch {
+	case os.IsNotExist(err):
+		// ignore
+	case err != nil:
+		log.Printf("warning: %s: %s, re-creating", path, err)
+		db.dirty = true
+	default:
+		db.entries = entries
+	}
+	if Debug {
+		log.Printf("DEPS: loaded %d entries from %q", len(db.entries), path)
+	}
+	return db
+}
+
+// Dependencies returns the target and dependencies of an object file
+// using the database entry for the object if its .d file has not
+// changed, otherwise by reading the .d file. As with the Compiler's
+// ReadDependencies method, a missing .d file results in an error
+// satisfying os.IsNotExist.
+//
+func (db *DepsDatabase) Dependencies(ofile, depsfile string) (string, []string, error) {
+	info, err := os.Stat(depsfile)
+	if os.IsNotExist(err) {
+		db.forget(ofile)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	db.mutex.Lock()
+	entry, found := db.entries[ofile]
+	db.mutex.Unlock()
+	if found && entry.depsfile == depsfile && entry.modtime.Equal(info.ModTime()) && entry.size == info.Size() {
+		return entry.target, entry.deps, nil
+	}
+	if Debug {
+		log.Printf("DEPS: %q not in database, reading %q", ofile, depsfile)
+	}
+	return db.ingest(ofile, depsfile, info)
+}
+
+// Ingest reads the .d file generated when compiling an object file
+// and adds its content to the database.
+//
+func (db *DepsDatabase) Ingest(ofile, depsfile string) error {
+	info, err := os.Stat(depsfile)
+	if err != nil {
+		return err
+	}
+	_, _, err = db.ingest(ofile, depsfile, info)
+	return err
+}
+
+func (db *DepsDatabase) ingest(ofile, depsfile string, info os.FileInfo) (string, []string, error) {
+	target, deps, err := ActualCompiler.ReadDependencies(depsfile)
+	if err != nil {
+		return "", nil, err
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	for index := range deps {
+		deps[index] = db.intern(deps[index])
+	}
+	db.entries[ofile] = &depsEntry{
+		depsfile: depsfile,
+		modtime:  info.ModTime(),
+		size:     info.Size(),
+		target:   target,
+		deps:     deps,
+	}
+	db.touched[ofile] = true
+	db.dirty = true
+	return target, deps, nil
+}
+
+// forget removes the entry for an object file whose .d file no longer
+// exists.
+//
+func (db *DepsDatabase) forget(ofile string) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if _, found := db.entries[ofile]; found {
+		delete(db.entries, ofile)
+		db.touched[ofile] = true
+		db.dirty = true
+	}
+}
+
+// intern returns the canonical copy of a string. The caller must hold
+// the receiver's mutex.
+//
+func (db *DepsDatabase) intern(s string) string {
+	if t, found := db.strings[s]; found {
+		return t
+	}
+	db.strings[s] = s
+	return s
+}
+
+// Save writes the database to its file if it has changed since being
+// loaded. Other dcc processes may have updated the file in the mean
+// time so, while holding the file's lock, the file is re-read and the
+// entries changed by the receiver merged into its content. An entry
+// in the file newer than the receiver's is retained. The new file is
+// written to a temporary file which is then renamed so readers never
+// see a partial file.
+//
+func (db *DepsDatabase) Save() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if !db.dirty {
+		return nil
+	}
+	if err := Mkdir(filepath.Dir(db.path)); err != nil {
+		return err
+	}
+	unlock, err := LockFile(db.path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if current, err := db.read(); err == nil {
+		for ofile := range db.touched {
+			mine, found := db.entries[ofile]
+			theirs, known := current[ofile]
+			switch {
+			case !found:
+				delete(current, ofile)
+			case known && theirs.modtime.After(mine.modtime):
+				// keep theirs
+			default:
+				current[ofile] = mine
+			}
+		}
+		db.entries = current
+	}
+	for ofile := range db.touched {
+		if entry, found := db.entries[ofile]; found {
+			if _, err := os.Stat(entry.depsfile); os.IsNotExist(err) {
+				delete(db.entries, ofile)
+			}
+		}
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(db.path), DepsDatabaseFilename+".*")
+	if err != nil {
+		return err
+	}
+	err = db.write(tmp)
+	if err2 := tmp.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), db.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	db.touched = make(map[string]bool)
+	db.dirty = false
+	if Debug {
+		log.Printf("DEPS: wrote %d entries to %q", len(db.entries), db.path)
+	}
+	return nil
+}
+
+// write encodes the receiver's entries to the given io.Writer.
+//
+func (db *DepsDatabase) write(w io.Writer) error {
+	var buf bytes.Buffer
+	var scratch [binary.MaxVarintLen64]byte
+
+	putUvarint := func(n uint64) {
+		buf.Write(scratch[:binary.PutUvarint(scratch[:], n)])
+	}
+	putVarint := func(n int64) {
+		buf.Write(scratch[:binary.PutVarint(scratch[:], n)])
+	}
+
+	// Build the string table.
+	//
+	index := make(map[string]uint64)
+	var table []string
+	add := func(s string) {
+		if _, found := index[s]; !found {
+			index[s] = uint64(len(table))
+			table = append(table, s)
+		}
+	}
+	for ofile, entry := range db.entries {
+		add(ofile)
+		add(entry.depsfile)
+		add(entry.target)
+		for _, dep := range entry.deps {
+			add(dep)
+		}
+	}
+
+	buf.Write(depsDatabaseMagic)
+	putUvarint(depsDatabaseVersion)
+	putUvarint(uint64(len(table)))
+	for _, s := range table {
+		putUvarint(uint64(len(s)))
+		buf.WriteString(s)
+	}
+	putUvarint(uint64(len(db.entries)))
+	for ofile, entry := range db.entries {
+		putUvarint(index[ofile])
+		putUvarint(index[entry.depsfile])
+		putVarint(entry.modtime.UnixNano())
+		putVarint(entry.size)
+		putUvarint(index[entry.target])
+		putUvarint(uint64(len(entry.deps)))
+		for _, dep := range entry.deps {
+			putUvarint(index[dep])
+		}
+	}
+	binary.Write(&buf, binary.LittleEndian, crc32.ChecksumIEEE(buf.Bytes()))
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// read reads and decodes the receiver's file returning the entries
+// it defines. Path names are interned in the receiver's string table
+// so the caller must hold the receiver's mutex, or otherwise have
+// exclusive access to the receiver.
+//
+func (db *DepsDatabase) read() (map[string]*depsEntry, error) {
+	data, err := ioutil.ReadFile(db.path)
+	if err != nil {
+		return nil, err
+	}
+	n := len(data) - 4
+	if n < len(depsDatabaseMagic) || !bytes.Equal(data[:len(depsDatabaseMagic)], depsDatabaseMagic) {
+		return nil, ErrBadDepsDatabase
+	}
+	if binary.LittleEndian.Uint32(data[n:]) != crc32.ChecksumIEEE(data[:n]) {
+		return nil, ErrBadDepsDatabase
+	}
+
+	r := bufio.NewReader(bytes.NewReader(data[len(depsDatabaseMagic):n]))
+	var rerr error
+	uvarint := func() uint64 {
+		v, err := binary.ReadUvarint(r)
+		if err != nil && rerr == nil {
+			rerr = ErrBadDepsDatabase
+		}
+		return v
+	}
+	varint := func() int64 {
+		v, err := binary.ReadVarint(r)
+		if err != nil && rerr == nil {
+			rerr = ErrBadDepsDatabase
+		}
+		return v
+	}
+
+	if uvarint() != depsDatabaseVersion {
+		return nil, ErrBadDepsDatabase
+	}
+
+	count := uvarint()
+	if rerr != nil || count > uint64(n) {
+		return nil, ErrBadDepsDatabase
+	}
+	table := make([]string, count)
+	for i := range table {
+		length := uvarint()
+		if rerr != nil || length > uint64(n) {
+			return nil, ErrBadDepsDatabase
+		}
+		s := make([]byte, length)
+		if _, err := io.ReadFull(r, s); err != nil {
+			return nil, ErrBadDepsDatabase
+		}
+		table[i] = db.intern(string(s))
+	}
+	lookup := func() string {
+		i := uvarint()
+		if i >= uint64(len(table)) {
+			if rerr == nil {
+				rerr = ErrBadDepsDatabase
+			}
+			return ""
+		}
+		return table[i]
+	}
+
+	count = uvarint()
+	if rerr != nil || count > uint64(n) {
+		return nil, ErrBadDepsDatabase
+	}
+	entries := make(map[string]*depsEntry, count)
+	for ; count > 0; count-- {
+		ofile := lookup()
+		entry := &depsEntry{
+			depsfile: lookup(),
+			modtime:  time.Unix(0, varint()),
+			size:     varint(),
+			target:   lookup(),
+		}
+		ndeps := uvarint()
+		if rerr != nil || ndeps > uint64(n) {
+			return nil, ErrBadDepsDatabase
+		}
+		entry.deps = make([]string, ndeps)
+		for i := range entry.deps {
+			entry.deps[i] = lookup()
+		}
+		if rerr != nil {
+			return nil, rerr
+		}
+		entries[ofile] = entry
+	}
+	return entries, nil
+}
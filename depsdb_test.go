@@ -0,0 +1,118 @@
+// dcc - dependency-driven C/C++ compiler front end
+//
+// Copyright © A.Newman 2015.
+//
+// This source code is released under version 2 of the  GNU Public License.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestDepsDatabase(t *testing.T) {
+	setupTest(t)
+	defer removeTestDirs(t)
+
+	ActualCompiler = NewGccStyleCompiler("cc")
+
+	ofile := filepath.Join(testProjectRootDir, "main.o")
+	depsfile := filepath.Join(testProjectRootDir, "main.o.d")
+	makeFileWithContent(t, depsfile, "main.o: main.c \\\n  a.h b.h\n")
+
+	dbfile := filepath.Join(testProjectRootDir, DepsDatabaseFilename)
+	db := LoadDepsDatabase(dbfile)
+	if err := db.Ingest(ofile, depsfile); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Change the .d file's content, but not its modtime or size, to
+	// ensure the dependencies come from the database.
+	//
+	info, err := os.Stat(depsfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	makeFileWithContent(t, depsfile, "main.o: main.c \\\n  x.h y.h\n")
+	if err := os.Chtimes(depsfile, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"main.c", "a.h", "b.h"}
+	db = LoadDepsDatabase(dbfile)
+	target, deps, err := db.Dependencies(ofile, depsfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "main.o" || !reflect.DeepEqual(deps, expected) {
+		t.Fatalf("got %q %q, expected %q %q", target, deps, "main.o", expected)
+	}
+
+	// A corrupt database is ignored and the .d file used instead.
+	//
+	expected = []string{"main.c", "x.h", "y.h"}
+	makeFileWithContent(t, dbfile, "garbage")
+	db = LoadDepsDatabase(dbfile)
+	_, deps, err = db.Dependencies(ofile, depsfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(deps, expected) {
+		t.Fatalf("got %q, expected %q", deps, expected)
+	}
+
+	// No .d file, no dependencies.
+	//
+	if err := os.Remove(depsfile); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = db.Dependencies(ofile, depsfile); !os.IsNotExist(err) {
+		t.Fatalf("expected a not-exist error, got %v", err)
+	}
+}
+
+func TestDepsDatabaseConcurrentSaves(t *testing.T) {
+	setupTest(t)
+	defer removeTestDirs(t)
+
+	ActualCompiler = NewGccStyleCompiler("cc")
+	dbfile := filepath.Join(testProjectRootDir, DepsDatabaseFilename)
+
+	// Each "process" loads the database, adds its own object and
+	// saves the database. No entries may be lost.
+	//
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		ofile := filepath.Join(testProjectRootDir, fmt.Sprintf("obj%d.o", i))
+		depsfile := ofile + ".d"
+		makeFileWithContent(t, depsfile, fmt.Sprintf("obj%d.o: obj%d.c\n", i, i))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			db := LoadDepsDatabase(dbfile)
+			if err := db.Ingest(ofile, depsfile); err != nil {
+				t.Error(err)
+			}
+			if err := db.Save(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	db := LoadDepsDatabase(dbfile)
+	if len(db.entries) != n {
+		t.Fatalf("database has %d entries, expected %d", len(db.entries), n)
+	}
+}
@@ -0,0 +1,270 @@
+// dcc - dependency-driven C/C++ compiler front end
+//
+// Copyright © A.Newman 2015.
+//
+// This source code is released under version 2 of the  GNU Public License.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Diagnostic is a single diagnostic, error, warning or note, output
+// by the compiler.
+//
+type Diagnostic struct {
+	File     string `json:"file"`            // source file, as named by the compiler
+	Line     int    `json:"line,omitempty"`   // line number, 0 if unknown
+	Column   int    `json:"column,omitempty"` // column number, 0 if unknown
+	Severity string `json:"severity"`         // "error", "warning", "note", etc...
+	Message  string `json:"message"`          // the text of the diagnostic
+	Check    string `json:"check,omitempty"`  // the option or code identifying the check, e.g. -Wunused-variable, C4101
+}
+
+// String returns the receiver in the gcc-style format.
+//
+func (d *Diagnostic) String() string {
+	var b strings.Builder
+	b.WriteString(d.File)
+	if d.Line > 0 {
+		fmt.Fprintf(&b, ":%d", d.Line)
+		if d.Column > 0 {
+			fmt.Fprintf(&b, ":%d", d.Column)
+		}
+	}
+	fmt.Fprintf(&b, ": %s: %s", d.Severity, d.Message)
+	if d.Check != "" {
+		fmt.Fprintf(&b, " [%s]", d.Check)
+	}
+	return b.String()
+}
+
+// IsWarning returns true if the receiver is a warning.
+//
+func (d *Diagnostic) IsWarning() bool {
+	return d.Severity == "warning"
+}
+
+// IsNote returns true if the receiver is a note, additional
+// information about the preceding diagnostic.
+//
+func (d *Diagnostic) IsNote() bool {
+	return d.Severity == "note"
+}
+
+// IsError returns true if the receiver is an error.
+//
+func (d *Diagnostic) IsError() bool {
+	return d.Severity == "error" || d.Severity == "fatal error"
+}
+
+var (
+	// file:line:column: severity: message [-Wflag]
+	//
+	gccDiagnostic = regexp.MustCompile(`^(.+?):(\d+):(?:(\d+):)? (fatal error|error|warning|note|remark): (.*)$`)
+
+	// file(line[,column]): severity code: message
+	//
+	msvcDiagnostic = regexp.MustCompile(`^(.+?)\((\d+)(?:,(\d+))?\) ?: (fatal error|error|warning|note) ?([A-Z]+\d+)?: (.*)$`)
+
+	// The trailing [-Wflag] of a gcc or clang diagnostic.
+	//
+	gccCheck = regexp.MustCompile(` \[(-W[^\]]*)\]$`)
+)
+
+// ParseDiagnostic parses a single line of compiler output. It returns
+// false if the line is not a diagnostic. Both gcc/clang and Microsoft
+// formats are recognized.
+//
+func ParseDiagnostic(line string) (Diagnostic, bool) {
+	var d Diagnostic
+	if m := gccDiagnostic.FindStringSubmatch(line); m != nil {
+		d.File = m[1]
+		d.Line, _ = strconv.Atoi(m[2])
+		d.Column, _ = strconv.Atoi(m[3])
+		d.Severity = m[4]
+		d.Message = m[5]
+		if c := gccCheck.FindStringSubmatchIndex(d.Message); c != nil {
+			d.Check = normalizeCheck(d.Message[c[2]:c[3]])
+			d.Message = d.Message[:c[0]]
+		}
+		return d, true
+	}
+	if m := msvcDiagnostic.FindStringSubmatch(line); m != nil {
+		d.File = m[1]
+		d.Line, _ = strconv.Atoi(m[2])
+		d.Column, _ = strconv.Atoi(m[3])
+		d.Severity = m[4]
+		d.Check = m[5]
+		d.Message = m[6]
+		return d, true
+	}
+	return d, false
+}
+
+// normalizeCheck removes any -Werror= prefix from a check name so the
+// same check is named the same way regardless of it being an error.
+//
+func normalizeCheck(check string) string {
+	if i := strings.IndexByte(check, ','); i != -1 {
+		check = check[:i]
+	}
+	if strings.HasPrefix(check, "-Werror=") {
+		return "-W" + strings.TrimPrefix(check, "-Werror=")
+	}
+	return check
+}
+
+// ParseDiagnostics parses the output of a compilation returning the
+// diagnostics it contains. Any terminal escape sequences are removed
+// first. As well as the usual text output the JSON output by gcc's
+// -fdiagnostics-format=json is recognized.
+//
+func ParseDiagnostics(output []byte) []Diagnostic {
+	var diagnostics []Diagnostic
+	input := bufio.NewScanner(bytes.NewReader(StripEscapes(output)))
+	input.Buffer(nil, 16*1024*1024)
+	for input.Scan() {
+		line := strings.TrimRight(input.Text(), "\r")
+		if strings.HasPrefix(line, "[{") {
+			if d, err := parseGccJSONDiagnostics([]byte(line)); err == nil {
+				diagnostics = append(diagnostics, d...)
+				continue
+			}
+		}
+		if d, ok := ParseDiagnostic(line); ok {
+			diagnostics = append(diagnostics, d)
+		}
+	}
+	return diagnostics
+}
+
+// gccJSONDiagnostic is a diagnostic as output by gcc's
+// -fdiagnostics-format=json.
+//
+type gccJSONDiagnostic struct {
+	Kind      string `json:"kind"`
+	Message   string `json:"message"`
+	Option    string `json:"option"`
+	Locations []struct {
+		Caret struct {
+			File   string `json:"file"`
+			Line   int    `json:"line"`
+			Column int    `json:"column"`
+		} `json:"caret"`
+	} `json:"locations"`
+	Children []gccJSONDiagnostic `json:"children"`
+}
+
+// parseGccJSONDiagnostics parses the JSON array of diagnostics output
+// by gcc. Each diagnostic's children, its notes, follow it as they
+// would in gcc's text output.
+//
+func parseGccJSONDiagnostics(data []byte) ([]Diagnostic, error) {
+	var items []gccJSONDiagnostic
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, err
+	}
+	var diagnostics []Diagnostic
+	var convert func(items []gccJSONDiagnostic)
+	convert = func(items []gccJSONDiagnostic) {
+		for _, item := range items {
+			d := Diagnostic{
+				Severity: item.Kind,
+				Message:  item.Message,
+				Check:    normalizeCheck(item.Option),
+			}
+			if len(item.Locations) > 0 {
+				d.File = item.Locations[0].Caret.File
+				d.Line = item.Locations[0].Caret.Line
+				d.Column = item.Locations[0].Caret.Column
+			}
+			diagnostics = append(diagnostics, d)
+			convert(item.Children)
+		}
+	}
+	convert(items)
+	return diagnostics, nil
+}
+
+// DiagnosticSet collects the diagnostics output by the compilations
+// performed during a build. The same diagnostic, e.g. a warning in
+// a header file included by many source files, is only collected
+// once, along with the notes that follow it. Every occurrence of a
+// warning is however counted (see Warnings). A DiagnosticSet may be
+// used concurrently.
+//
+type DiagnosticSet struct {
+	mutex    sync.Mutex
+	seen     map[Diagnostic]bool
+	items    []Diagnostic
+	warnings []Diagnostic // every warning, including duplicates
+}
+
+// Add adds the diagnostics in some compiler output to the receiver.
+//
+func (s *DiagnosticSet) Add(output []byte) {
+	diagnostics := ParseDiagnostics(output)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.seen == nil {
+		s.seen = make(map[Diagnostic]bool)
+	}
+	duplicate := false
+	for _, d := range diagnostics {
+		if d.IsWarning() {
+			s.warnings = append(s.warnings, d)
+		}
+		if !d.IsNote() {
+			duplicate = s.seen[d]
+			s.seen[d] = true
+		}
+		if !duplicate {
+			s.items = append(s.items, d)
+		}
+	}
+}
+
+// Items returns the diagnostics in the receiver in the order they were
+// added.
+//
+func (s *DiagnosticSet) Items() []Diagnostic {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Diagnostic(nil), s.items...)
+}
+
+// Warnings returns every warning added to the receiver, in the order
+// they were added. Unlike Items, a warning output more than once,
+// e.g. by every source including a header, occurs more than once.
+//
+func (s *DiagnosticSet) Warnings() []Diagnostic {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Diagnostic(nil), s.warnings...)
+}
+
+// WriteDiagnosticsJSON writes diagnostics to a file as JSON lines, one
+// JSON object per diagnostic.
+//
+func WriteDiagnosticsJSON(path string, diagnostics []Diagnostic) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, d := range diagnostics {
+		if err := enc.Encode(d); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0666)
+}
@@ -0,0 +1,149 @@
+// dcc - dependency-driven C/C++ compiler front end
+//
+// Copyright © A.Newman 2015.
+//
+// This source code is released under version 2 of the  GNU Public License.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseDiagnostics(t *testing.T) {
+	output := "main.c: In function 'main':\n" +
+		"main.c:4:9: warning: unused variable 'x' [-Wunused-variable]\n" +
+		"    4 |     int x;\n" +
+		"      |         ^\n" +
+		"\x1b[01m\x1b[Kutil.h:12:1: \x1b[01;31m\x1b[Kerror: \x1b[m\x1b[Kexpected ';' before '}' token\n" +
+		"lib.c:20:5: error: implicit declaration of function 'f' [-Werror=implicit-function-declaration]\n" +
+		"foo.cpp(42): warning C4996: 'strcpy': This function may be unsafe.\r\n" +
+		"foo.cpp(7,3): error C2065: 'y': undeclared identifier\n"
+
+	expected := []Diagnostic{
+		{"main.c", 4, 9, "warning", "unused variable 'x'", "-Wunused-variable"},
+		{"util.h", 12, 1, "error", "expected ';' before '}' token", ""},
+		{"lib.c", 20, 5, "error", "implicit declaration of function 'f'", "-Wimplicit-function-declaration"},
+		{"foo.cpp", 42, 0, "warning", "'strcpy': This function may be unsafe.", "C4996"},
+		{"foo.cpp", 7, 3, "error", "'y': undeclared identifier", "C2065"},
+	}
+
+	actual := ParseDiagnostics([]byte(output))
+	if len(actual) != len(expected) {
+		t.Fatalf("got %d diagnostics, expected %d: %v", len(actual), len(expected), actual)
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Errorf("diagnostic %d: got %+v, expected %+v", i, actual[i], expected[i])
+		}
+	}
+}
+
+func TestWarningBaseline(t *testing.T) {
+	setupTest(t)
+	defer removeTestDirs(t)
+
+	source := filepath.Join(testProjectRootDir, "main.c")
+	warning := func(line int, message string) Diagnostic {
+		return Diagnostic{source, line, 1, "warning", message, "-Wunused-variable"}
+	}
+
+	baselineFile := filepath.Join(testProjectRootDir, "warnings.baseline")
+	err := WriteWarningBaseline(baselineFile, []Diagnostic{
+		warning(4, "unused variable 'x'"),
+		warning(5, "unused variable 'x'"),
+		warning(9, "unused variable 'y2'"),
+		warning(10, "array index 4 is past the end of the array (that has type 'int[4]')"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseline, err := ReadWarningBaseline(baselineFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Moved warnings, and numbers in messages, don't matter but a
+	// warning occurring more often than in the baseline is new, as
+	// are warnings differing in quoted names or numbers.
+	//
+	unexpected := baseline.NewWarnings([]Diagnostic{
+		warning(14, "unused variable 'x'"),
+		warning(15, "unused variable 'y3'"),
+		warning(16, "unused variable 'x'"),
+		warning(17, "unused variable 'x'"),
+		warning(18, "array index 6 is past the end of the array (that has type 'int[4]')"),
+		warning(19, "array index 6 is past the end of the array (that has type 'int[8]')"),
+	})
+	if len(unexpected) != 3 || unexpected[0].Line != 15 || unexpected[1].Line != 17 || unexpected[2].Line != 19 {
+		t.Errorf("unexpected new warnings: %v", unexpected)
+	}
+
+	if key := baseline.Key(warning(1, "unused  variable 'x'")); key != "main.c\t-Wunused-variable\tunused variable 'x'" {
+		t.Errorf("unexpected baseline key %q", key)
+	}
+
+	// Every occurrence of a warning counts, including the same
+	// warning in a header reported by two sources.
+	//
+	var diagnostics DiagnosticSet
+	header := []byte("a.h:3:5: warning: unused variable ‘z1’ [-Wunused-variable]\n")
+	diagnostics.Add(header)
+	diagnostics.Add(header)
+	if n := len(diagnostics.Warnings()); n != 2 {
+		t.Errorf("got %d warnings, expected 2", n)
+	}
+	if n := len(diagnostics.Items()); n != 1 {
+		t.Errorf("got %d diagnostics, expected 1", n)
+	}
+}
+
+func TestParseGccJSONDiagnostics(t *testing.T) {
+	output := `[{"kind": "warning", "locations": [{"caret": {"line": 1, "file": "a.c", "column": 20}}], "option": "-Wunused-variable", "children": [{"kind": "note", "locations": [{"caret": {"line": 3, "file": "a.h", "column": 1}}], "message": "declared here"}], "message": "unused variable 'x'"}]` + "\n"
+
+	expected := []Diagnostic{
+		{"a.c", 1, 20, "warning", "unused variable 'x'", "-Wunused-variable"},
+		{"a.h", 3, 1, "note", "declared here", ""},
+	}
+
+	actual := ParseDiagnostics([]byte(output))
+	if len(actual) != len(expected) {
+		t.Fatalf("got %d diagnostics, expected %d: %v", len(actual), len(expected), actual)
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Errorf("diagnostic %d: got %+v, expected %+v", i, actual[i], expected[i])
+		}
+	}
+}
+
+func TestDiagnosticDeduper(t *testing.T) {
+	header := "In file included from %s.c:1:\n" +
+		"h.h: In function 'f':\n" +
+		"h.h:1:34: warning: unused variable 'y' [-Wunused-variable]\n" +
+		"    1 | static int f(int x) { int y; return x; }\n" +
+		"      |                                  ^\n"
+	source := "%s.c:2:1: warning: no newline at end of file\n"
+
+	dd := NewDiagnosticDeduper()
+	a := fmt.Sprintf(header, "a") + fmt.Sprintf(source, "a")
+	if output := string(dd.Filter([]byte(a))); output != a {
+		t.Errorf("first output changed: %q", output)
+	}
+	b := fmt.Sprintf(header, "b") + fmt.Sprintf(source, "b")
+	if output := string(dd.Filter([]byte(b))); output != fmt.Sprintf(source, "b") {
+		t.Errorf("duplicate not removed: %q", output)
+	}
+
+	var report strings.Builder
+	dd.Report(&report)
+	expected := "h.h:1:34: warning: unused variable 'y' [-Wunused-variable] (reported by 2 sources)\n"
+	if report.String() != expected {
+		t.Errorf("got report %q, expected %q", report.String(), expected)
+	}
+}
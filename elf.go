@@ -11,8 +11,6 @@
 package main
 
 import (
-	"fmt"
-	"os"
 	"strings"
 )
 
@@ -21,12 +19,13 @@ import (
 //
 func ElfCreateLibrary(filename string, objectFiles []string) error {
 	args := append([]string{"rc", filename}, objectFiles...)
+	displayed := ""
 	if Verbose {
-		fmt.Fprintln(os.Stdout, "ar", strings.Join(args, " "))
+		displayed = "ar " + strings.Join(args, " ")
 	} else if !Quiet {
-		fmt.Fprintln(os.Stdout, "ar", filename)
+		displayed = "ar " + filename
 	}
-	return Exec("ar", args, os.Stderr)
+	return RunAction(ActionLib, filename, displayed, "ar", args)
 }
 
 // ElfCreateDLL creates a dynamic library using the compiler, passing
@@ -37,10 +36,11 @@ func ElfCreateDLL(filename string, objectFiles []string, libraryFiles []string,
 	args = append(args, linkerOptions...)
 	args = append(args, objectFiles...)
 	args = append(args, libraryFiles...)
+	displayed := ""
 	if Verbose {
-		fmt.Fprintln(os.Stdout, ActualCompiler.Name(), strings.Join(args, " "))
+		displayed = ActualCompiler.Name() + " " + strings.Join(args, " ")
 	} else if !Quiet {
-		fmt.Fprintln(os.Stdout, "ld", filename)
+		displayed = "ld " + filename
 	}
-	return Exec(ActualCompiler.Name(), args, os.Stderr)
+	return RunAction(ActionDll, filename, displayed, ActualCompiler.Name(), args)
 }
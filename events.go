@@ -0,0 +1,190 @@
+// dcc - dependency-driven C/C++ compiler front end
+//
+// Copyright © A.Newman 2015.
+//
+// This source code is released under version 2 of the  GNU Public License.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Build events.
+//
+// With --events dcc writes a stream of events, one JSON object per
+// line, describing what it is doing as it does it. The stream is
+// intended to be read by other programs, IDEs, dashboards and the
+// like, that want to follow the progress of a build without parsing
+// dcc's human-oriented output.
+//
+// Each event has an "event" member naming the event and a "time"
+// member. The events are,
+//
+//	build_started		dcc has started, with its arguments
+//	options_resolved	the options files read
+//	action_scheduled	an action, e.g. compiling a file, will be done
+//	action_started		an action has started
+//	action_finished		an action has finished, with its exit status and duration
+//	action_skipped		an action was not needed, with the reason why
+//	build_finished		the build has ended, with its exit status
+//
+// Dependency checks are actions but are not reported as events.
+//
+
+// Event is a single event in the build event stream. Members not
+// relevant to an event are omitted.
+//
+type Event struct {
+	Event      string    `json:"event"`
+	Time       time.Time `json:"time"`
+	Kind       string    `json:"kind,omitempty"`
+	Source     string    `json:"source,omitempty"`
+	Target     string    `json:"target,omitempty"`
+	Worker     *int      `json:"worker,omitempty"`
+	Status     string    `json:"status,omitempty"`
+	ExitStatus *int      `json:"exit_status,omitempty"`
+	DurationMS *int64    `json:"duration_ms,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	Args       []string  `json:"args,omitempty"`
+	Directory  string    `json:"directory,omitempty"`
+	Files      *[]string `json:"files,omitempty"`
+}
+
+// EventStream writes build events. An EventStream may be used
+// concurrently.
+//
+type EventStream struct {
+	mutex  sync.Mutex
+	closer io.Closer // nil unless we created the file
+	enc    *json.Encoder
+	start  time.Time
+}
+
+// OpenEventStream opens the event stream named by the argument to
+// --events. This is either the number of an open file descriptor
+// or the name of a file. Descriptors belong to whoever gave them
+// to us and are left open, only files we create are closed.
+//
+func OpenEventStream(name string) (*EventStream, error) {
+	s := &EventStream{start: time.Now()}
+	if fd, err := strconv.Atoi(name); err == nil && fd >= 0 {
+		switch fd {
+		case 1:
+			s.enc = json.NewEncoder(os.Stdout)
+		case 2:
+			s.enc = json.NewEncoder(os.Stderr)
+		default:
+			s.enc = json.NewEncoder(os.NewFile(uintptr(fd), "events"))
+		}
+	} else {
+		file, err := os.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		s.enc, s.closer = json.NewEncoder(file), file
+	}
+	return s, nil
+}
+
+// emit writes an event to the stream.
+//
+func (s *EventStream) emit(e *Event) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	e.Time = time.Now()
+	s.enc.Encode(e) // errors are ignored, events are not essential
+}
+
+// actionEvent returns the event for an action.
+//
+func actionEvent(event string, a *Action) *Event {
+	e := &Event{
+		Event:  event,
+		Kind:   a.Kind,
+		Source: a.Source,
+		Target: a.Target,
+	}
+	if a.Worker >= 0 {
+		worker := a.Worker
+		e.Worker = &worker
+	}
+	return e
+}
+
+// BuildStarted emits the build_started event.
+//
+func (s *EventStream) BuildStarted(args []string, dir string) {
+	s.emit(&Event{Event: "build_started", Args: args, Directory: dir})
+}
+
+// OptionsResolved emits the options_resolved event.
+//
+func (s *EventStream) OptionsResolved(options ...*Options) {
+	files := []string{}
+	for _, o := range options {
+		files = append(files, o.Files...)
+	}
+	s.emit(&Event{Event: "options_resolved", Files: &files})
+}
+
+// ActionScheduled implements BuildObserver.
+//
+func (s *EventStream) ActionScheduled(a *Action) {
+	if a.Kind != ActionScan {
+		s.emit(actionEvent("action_scheduled", a))
+	}
+}
+
+// ActionStarted implements BuildObserver.
+//
+func (s *EventStream) ActionStarted(a *Action) {
+	if a.Kind != ActionScan {
+		s.emit(actionEvent("action_started", a))
+	}
+}
+
+// ActionFinished implements BuildObserver.
+//
+func (s *EventStream) ActionFinished(a *Action) {
+	switch {
+	case a.Kind == ActionScan:
+		return
+	case a.Skipped:
+		e := actionEvent("action_skipped", a)
+		e.Reason = a.Reason
+		s.emit(e)
+	default:
+		e := actionEvent("action_finished", a)
+		e.Status = "ok"
+		if a.Err != nil {
+			e.Status = "failed"
+		}
+		exitStatus := a.ExitStatus()
+		duration := a.Duration().Milliseconds()
+		e.ExitStatus, e.DurationMS = &exitStatus, &duration
+		s.emit(e)
+	}
+}
+
+// BuildFinished emits the build_finished event and closes the
+// stream if we opened it.
+//
+func (s *EventStream) BuildFinished(exitStatus int) {
+	status := "ok"
+	if exitStatus != 0 {
+		status = "failed"
+	}
+	duration := time.Since(s.start).Milliseconds()
+	s.emit(&Event{Event: "build_finished", Status: status, ExitStatus: &exitStatus, DurationMS: &duration})
+	if s.closer != nil {
+		s.closer.Close()
+	}
+}
@@ -9,17 +9,20 @@
 package main
 
 import (
+	"bytes"
 	"io"
 	"log"
 	"os"
 	"os/exec"
 	"strings"
+	"time"
 )
 
 // Exec executes a command with the supplied arguments and directs its
 // standard error output stream to the supplied io.Writer. The
 // command's standard input is connected to /dev/null and the output
-// stream connected to our standard output.
+// stream connected to our standard output. Output is written via
+// the status line so the two do not become mixed.
 //
 func Exec(path string, args []string, stderr io.Writer) error {
 	if Debug {
@@ -27,6 +30,52 @@ func Exec(path string, args []string, stderr io.Writer) error {
 	}
 
 	cmd := exec.Command(path, args...)
-	cmd.Stdin, cmd.Stdout, cmd.Stderr = nil, os.Stdout, stderr
-	return cmd.Run()
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = nil, Status.Writer(os.Stdout), Status.Writer(stderr)
+	return run(cmd)
+}
+
+// ExecWithOutput executes a command with the supplied arguments and
+// directs both its standard output and standard error streams to the
+// supplied io.Writer. Using the same io.Writer for both streams has
+// the command write to a single pipe so the output of each stream
+// is kept in order with respect to the other.
+//
+func ExecWithOutput(path string, args []string, w io.Writer) error {
+	if Debug {
+		log.Println("EXEC:", path, strings.Join(args, " "))
+	}
+
+	cmd := exec.Command(path, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = nil, w, w
+	return run(cmd)
+}
+
+// run runs a command and adds the CPU time it used to the build
+// report (report.go).
+//
+func run(cmd *exec.Cmd) error {
+	err := cmd.Run()
+	if cmd.ProcessState != nil {
+		Report.AddCPUTime(cmd.ProcessState.UserTime() + cmd.ProcessState.SystemTime())
+	}
+	return err
+}
+
+// RunAction runs a command, as per Exec, to perform a build action of
+// the given kind, creating target. The action's description is output
+// on the status line (status.go) and the action is recorded in the
+// build report (report.go).
+//
+func RunAction(kind, target, description, path string, args []string) error {
+	var output bytes.Buffer
+	action := &Action{Kind: kind, Target: target, Worker: -1}
+	Report.Schedule(action)
+	Report.Begin(action)
+	Status.Start(description)
+	action.Err = Exec(path, args, io.MultiWriter(os.Stderr, &output))
+	action.Output = output.Bytes()
+	action.End = time.Now()
+	Status.Finish(action.Err == nil)
+	Report.Record(action)
+	return action.Err
 }
@@ -0,0 +1,332 @@
+// dcc - dependency-driven C/C++ compiler front end
+//
+// Copyright © A.Newman 2015.
+//
+// This source code is released under version 2 of the  GNU Public License.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Conditional expressions.
+//
+// The !if and !elif directives in options files take an expression.
+// Expressions operate on strings. Words, quoted strings and variable
+// references (words.go) are values and the operators are,
+//
+//	( expr )			grouping
+//	defined(VAR)			true if VAR is defined and not empty
+//	! value				logical not
+//	a == b, a != b			equality
+//	a < b, a <= b, a > b, a >= b	ordering
+//	expr && expr, expr || expr	logical and, or
+//
+// The operators are listed from highest to lowest precedence and, as
+// in C, ! binds more tightly than the comparisons, !a == b is (!a) == b.
+//
+// Values starting with a digit are compared as version numbers,
+// e.g. 4.10 is greater than 4.9, other values are compared as
+// strings. A value used as a condition is true if it is not empty
+// and not "0". Operators yield "1" for true and "0" for false.
+//
+
+const (
+	exprTrue  = "1"
+	exprFalse = "0"
+)
+
+type exprTokenKind int
+
+const (
+	exprEOF exprTokenKind = iota
+	exprWord
+	exprString
+	exprOperator
+)
+
+type exprToken struct {
+	kind exprTokenKind
+	text string
+}
+
+// exprOperators are the operators, longest first so "<=" is found
+// before "<".
+//
+var exprOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")"}
+
+// tokenizeExpr splits an expression into tokens.
+//
+func tokenizeExpr(s string) ([]exprToken, error) {
+	var tokens []exprToken
+	i := 0
+next:
+	for i < len(s) {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t':
+			i++
+			continue
+		case c == '"':
+			end := strings.IndexByte(s[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string in expression")
+			}
+			tokens = append(tokens, exprToken{exprString, s[i+1 : i+1+end]})
+			i += end + 2
+			continue
+		}
+		for _, op := range exprOperators {
+			if strings.HasPrefix(s[i:], op) {
+				tokens = append(tokens, exprToken{exprOperator, op})
+				i += len(op)
+				continue next
+			}
+		}
+		start := i
+		for i < len(s) && !isExprDelimiter(s, i) {
+			if s[i] == '$' && i+1 < len(s) && s[i+1] == '{' {
+				end := closingBrace(s[i:])
+				if end < 0 {
+					return nil, fmt.Errorf("unterminated variable reference in expression")
+				}
+				i += end + 1
+				continue
+			}
+			i++
+		}
+		if i == start {
+			return nil, fmt.Errorf("unexpected %q in expression", s[i:i+1])
+		}
+		tokens = append(tokens, exprToken{exprWord, s[start:i]})
+	}
+	return append(tokens, exprToken{kind: exprEOF}), nil
+}
+
+func isExprDelimiter(s string, i int) bool {
+	if strings.IndexByte(" \t\"()<>=&|", s[i]) >= 0 {
+		return true
+	}
+	return s[i] == '!' && i+1 < len(s) && s[i+1] == '='
+}
+
+// exprParser is a recursive descent parser, and evaluator, of
+// conditional expressions.
+//
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+	lookup func(string) ([]string, bool)
+}
+
+// EvalExpr evaluates a conditional expression using the lookup
+// function to obtain the values of variables.
+//
+func EvalExpr(s string, lookup func(string) ([]string, bool)) (bool, error) {
+	tokens, err := tokenizeExpr(s)
+	if err != nil {
+		return false, err
+	}
+	if len(tokens) == 1 {
+		return false, fmt.Errorf("missing expression")
+	}
+	p := &exprParser{tokens: tokens, lookup: lookup}
+	value, err := p.or()
+	if err != nil {
+		return false, err
+	}
+	if t := p.peek(); t.kind != exprEOF {
+		return false, fmt.Errorf("unexpected %q in expression", t.text)
+	}
+	return exprTruth(value), nil
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	t := p.tokens[p.pos]
+	if t.kind != exprEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *exprParser) accept(op string) bool {
+	if t := p.peek(); t.kind == exprOperator && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) or() (string, error) {
+	lhs, err := p.and()
+	for err == nil && p.accept("||") {
+		var rhs string
+		if rhs, err = p.and(); err == nil {
+			lhs = exprBool(exprTruth(lhs) || exprTruth(rhs))
+		}
+	}
+	return lhs, err
+}
+
+func (p *exprParser) and() (string, error) {
+	lhs, err := p.comparison()
+	for err == nil && p.accept("&&") {
+		var rhs string
+		if rhs, err = p.comparison(); err == nil {
+			lhs = exprBool(exprTruth(lhs) && exprTruth(rhs))
+		}
+	}
+	return lhs, err
+}
+
+func (p *exprParser) comparison() (string, error) {
+	lhs, err := p.unary()
+	if err != nil {
+		return "", err
+	}
+	t := p.peek()
+	if t.kind != exprOperator {
+		return lhs, nil
+	}
+	var test func(int) bool
+	switch t.text {
+	case "==":
+		test = func(n int) bool { return n == 0 }
+	case "!=":
+		test = func(n int) bool { return n != 0 }
+	case "<":
+		test = func(n int) bool { return n < 0 }
+	case "<=":
+		test = func(n int) bool { return n <= 0 }
+	case ">":
+		test = func(n int) bool { return n > 0 }
+	case ">=":
+		test = func(n int) bool { return n >= 0 }
+	default:
+		return lhs, nil
+	}
+	p.next()
+	rhs, err := p.unary()
+	if err != nil {
+		return "", err
+	}
+	return exprBool(test(CompareValues(lhs, rhs))), nil
+}
+
+// unary parses a value, possibly negated.
+//
+func (p *exprParser) unary() (string, error) {
+	if p.accept("!") {
+		value, err := p.unary()
+		return exprBool(!exprTruth(value)), err
+	}
+	return p.primary()
+}
+
+func (p *exprParser) primary() (string, error) {
+	t := p.next()
+	switch {
+	case t.kind == exprOperator && t.text == "(":
+		value, err := p.or()
+		if err == nil && !p.accept(")") {
+			err = fmt.Errorf("missing ) in expression")
+		}
+		return value, err
+	case t.kind == exprWord && t.text == "defined":
+		return p.defined()
+	case t.kind == exprWord || t.kind == exprString:
+		return ExpandReferences(t.text, p.lookup)
+	case t.kind == exprEOF:
+		return "", fmt.Errorf("unexpected end of expression")
+	default:
+		return "", fmt.Errorf("unexpected %q in expression", t.text)
+	}
+}
+
+// defined parses the remainder of defined(VAR), or defined VAR.
+//
+func (p *exprParser) defined() (string, error) {
+	paren := p.accept("(")
+	t := p.next()
+	if t.kind != exprWord {
+		return "", fmt.Errorf("defined requires a variable name")
+	}
+	if paren && !p.accept(")") {
+		return "", fmt.Errorf("missing ) after defined(%s", t.text)
+	}
+	words, found := p.lookup(t.text)
+	return exprBool(found && strings.Join(words, "") != ""), nil
+}
+
+func exprBool(b bool) string {
+	if b {
+		return exprTrue
+	}
+	return exprFalse
+}
+
+func exprTruth(value string) bool {
+	return value != "" && value != exprFalse
+}
+
+// CompareValues compares two values returning a negative number, zero
+// or a positive number if a is less than, equal to or greater than b.
+// Values that both start with a digit are compared as version
+// numbers, other values as strings.
+//
+func CompareValues(a, b string) int {
+	if !startsWithDigit(a) || !startsWithDigit(b) {
+		return strings.Compare(a, b)
+	}
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for len(as) < len(bs) {
+		as = append(as, "0")
+	}
+	for len(bs) < len(as) {
+		bs = append(bs, "0")
+	}
+	for i := range as {
+		if n := compareVersionComponents(as[i], bs[i]); n != 0 {
+			return n
+		}
+	}
+	return 0
+}
+
+// compareVersionComponents compares the numeric prefixes of two
+// version number components, then any remainder as strings.
+//
+func compareVersionComponents(a, b string) int {
+	an, arest := splitDigits(a)
+	bn, brest := splitDigits(b)
+	an, bn = strings.TrimLeft(an, "0"), strings.TrimLeft(bn, "0")
+	if len(an) != len(bn) {
+		if len(an) < len(bn) {
+			return -1
+		}
+		return 1
+	}
+	if n := strings.Compare(an, bn); n != 0 {
+		return n
+	}
+	return strings.Compare(arest, brest)
+}
+
+func splitDigits(s string) (string, string) {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+func startsWithDigit(s string) bool {
+	return s != "" && s[0] >= '0' && s[0] <= '9'
+}
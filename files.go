@@ -31,18 +31,22 @@ var (
 // results in an non-nil error return and the most recently
 // set most recent time.
 //
+// Object files use the time their content last changed (see
+// cutoff.go) so re-compiling a file to an identical object does
+// not cause re-linking.
+//
 func NewestOf(filenames []string) (time.Time, error) {
 	var t time.Time
 	info, err := Stat(filenames[0])
 	if err != nil {
 		return t, err
 	}
-	t = info.ModTime()
+	t = EffectiveModTime(filenames[0], info)
 	for i := 1; i < len(filenames); i++ {
 		if s, err := Stat(filenames[i]); err != nil {
 			return t, err
-		} else if s.ModTime().After(t) {
-			t = s.ModTime()
+		} else if mtime := EffectiveModTime(filenames[i], s); mtime.After(t) {
+			t = mtime
 		}
 	}
 	return t, nil
@@ -97,12 +101,28 @@ func DepsFilename(path string) string {
 	return filepath.Join(dirname, DepsDir, basename) + ".d"
 }
 
+// LogFilename returns the name of the file used to save the output
+// of compiling a given object file. It resides alongside the object
+// file's dependencies file.
+//
+func LogFilename(path string) string {
+	return strings.TrimSuffix(DepsFilename(path), ".d") + ".log"
+}
+
 // Basename returns base portion of a path, the filename.Base(),
-// taking into account the possibility the path may have an OS
-// and/or architecture specific suffix, which is removed.
+// taking into account the possibility the path may have an OS,
+// architecture and/or compiler specific suffix, which is removed.
 //
 func Basename(path string) string {
 	b := filepath.Base(path)
+	if CompilerFamily != "" {
+		if s := OsAndCompilerSpecificFilename(""); strings.HasSuffix(b, s) {
+			return strings.TrimSuffix(b, s)
+		}
+		if s := CompilerSpecificFilename(""); strings.HasSuffix(b, s) {
+			return strings.TrimSuffix(b, s)
+		}
+	}
 	if strings.HasSuffix(b, OsArchSuffix) {
 		return strings.TrimSuffix(b, OsArchSuffix)
 	}
@@ -142,6 +162,28 @@ func ArchSpecificFilename(path string) string {
 	return path + ArchSuffix
 }
 
+// CompilerSpecificFilename returns the compiler-specific version of a
+// path (filename) by appending the CompilerFamily to the path. If the
+// compiler family isn't known the path is returned unchanged.
+//
+func CompilerSpecificFilename(path string) string {
+	if CompilerFamily == "" {
+		return path
+	}
+	return path + "." + CompilerFamily
+}
+
+// OsAndCompilerSpecificFilename returns the OS and compiler-specific
+// version of a path (filename), e.g. CFLAGS.linux_clang. If the
+// compiler family isn't known the path is returned unchanged.
+//
+func OsAndCompilerSpecificFilename(path string) string {
+	if CompilerFamily == "" {
+		return path
+	}
+	return path + OsSuffix + "_" + CompilerFamily
+}
+
 // OsAndArchSpecificFilename returns the architecture and OS-specfic
 // verson of a path (filename) by appending the OsArchSuffix to the
 // path.
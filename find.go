@@ -112,12 +112,22 @@ func FindFileInDirectory(filename string, dirname string) (string, os.FileInfo,
 		if path, info, found, err := try(dirname, OsAndArchSpecificFilename(filename)); err != nil || found {
 			return path, info, found, err
 		}
+		if CompilerFamily != "" {
+			if path, info, found, err := try(dirname, OsAndCompilerSpecificFilename(filename)); err != nil || found {
+				return path, info, found, err
+			}
+		}
 		if path, info, found, err := try(dirname, OsSpecificFilename(filename)); err != nil || found {
 			return path, info, found, err
 		}
 		if path, info, found, err := try(dirname, ArchSpecificFilename(filename)); err != nil || found {
 			return path, info, found, err
 		}
+		if CompilerFamily != "" {
+			if path, info, found, err := try(dirname, CompilerSpecificFilename(filename)); err != nil || found {
+				return path, info, found, err
+			}
+		}
 		return try(dirname, filename)
 	}
 
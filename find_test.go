@@ -17,7 +17,7 @@ import (
 
 func invalidateStatCache() {
 	statCacheMutex.Lock()
-	statCache = make(map[string]os.FileInfo)
+	statCache = make(map[string]*statEntry)
 	statCacheMutex.Unlock()
 }
 
@@ -119,3 +119,54 @@ func Test_FindFile_PlatformSpecificSearches(t *testing.T) {
 	singleFileTestCase(t, testProjectChildDir, OsSpecificFilename(testFilename), testProjectChildDir)
 	singleFileTestCase(t, testProjectDccDir, OsAndArchSpecificFilename(testFilename), testProjectChildDir)
 }
+
+func Test_FindFile_CompilerSpecificSearches(t *testing.T) {
+	setupTest(t)
+	defer removeTestDirs(t)
+	defer func(family string) { CompilerFamily = family }(CompilerFamily)
+	CompilerFamily = ClangFamily
+
+	invalidateStatCache()
+	generic := filepath.Join(testProjectChildDir, testFilename)
+	compilerSpecific := CompilerSpecificFilename(generic)
+	osAndCompilerSpecific := OsAndCompilerSpecificFilename(generic)
+	makeFile(t, generic)
+	makeFile(t, compilerSpecific)
+	makeFile(t, osAndCompilerSpecific)
+
+	expect := func(expected string) {
+		invalidateStatCache()
+		path, _, found, err := FindFileInDirectory(testFilename, testProjectChildDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || path != expected {
+			t.Fatalf("found %q, expected %q", path, expected)
+		}
+		if base := Basename(path); base != testFilename {
+			t.Fatalf("Basename(%q) is %q, expected %q", path, base, testFilename)
+		}
+	}
+
+	expect(osAndCompilerSpecific)
+	os.Remove(osAndCompilerSpecific)
+	expect(compilerSpecific)
+	CompilerFamily = GccFamily
+	expect(generic)
+}
+
+func Test_GetCompilerFamily(t *testing.T) {
+	tests := map[string]string{
+		"gcc":                     GccFamily,
+		"x86_64-linux-gnu-g++-12": GccFamily,
+		"clang++":                 ClangFamily,
+		"/usr/bin/clang-15":       ClangFamily,
+		"cl.exe":                  MsvcFamily,
+		"icpc":                    IntelFamily,
+	}
+	for name, expected := range tests {
+		if actual := GetCompilerFamily(name); actual != expected {
+			t.Errorf("%q: got %q, expected %q", name, actual, expected)
+		}
+	}
+}
@@ -13,13 +13,18 @@ import (
 	"bytes"
 	"io"
 	"io/ioutil"
+	"os"
+	"os/exec"
 	"strings"
+	"sync"
 )
 
 // GccStyleCompiler is-a CompilerDriver that uses gcc-style options to
 // generate make-format dependencies.
 type GccStyleCompiler struct {
-	command string
+	command    string
+	familyOnce sync.Once
+	family     string
 }
 
 // NewGccStyleCompiler returns a CompilerDriver using
@@ -39,10 +44,43 @@ func (gcc *GccStyleCompiler) Name() string {
 }
 
 // Compile runs the compiler to compile a source code to object code.
+// The compiler's standard output and standard error are both written
+// to the supplied io.Writer.
 func (gcc *GccStyleCompiler) Compile(source, object, deps string, options []string, w io.Writer) error {
+	// -MD, rather than -MMD, as -MMD also omits headers found via
+	// the user's -isystem directories. When skipping system headers
+	// those in the toolchain's directories are filtered out when the
+	// dependencies are checked.
+	//
+	args := gcc.compileArgs(source, object, options, []string{"-MD", "-MF", deps})
+	if ColorDiagnostics && gcc.supportsColor() {
+		// Before the user's options so they may override it.
+		args = append([]string{"-fdiagnostics-color=always"}, args...)
+	}
+	return ExecWithOutput(gcc.command, args, w)
+}
+
+// CompileCommand returns the command line used to compile a source
+// file, less the dependency generation options.
+func (gcc *GccStyleCompiler) CompileCommand(source, object string, options []string) []string {
+	return append([]string{gcc.command}, gcc.compileArgs(source, object, options, nil)...)
+}
+
+// compileArgs returns the arguments passed to the compiler to compile
+// a source file. The extra options follow the user's options.
+func (gcc *GccStyleCompiler) compileArgs(source, object string, options []string, extra []string) []string {
 	args := append([]string{}, options...)
-	args = append(args, "-MD", "-MF", deps, "-c", source, "-o", object)
-	return Exec(gcc.command, args, w)
+	args = append(args, extra...)
+	return append(args, "-c", source, "-o", object)
+}
+
+// supportsColor returns true if the compiler accepts gcc/clang's
+// -fdiagnostics-color option. Intel's compilers do not. The
+// compiler's family is determined once, it may involve searching
+// the PATH.
+func (gcc *GccStyleCompiler) supportsColor() bool {
+	gcc.familyOnce.Do(func() { gcc.family = GetCompilerFamily(gcc.command) })
+	return gcc.family == GccFamily || gcc.family == ClangFamily
 }
 
 // ReadDependencies reads make-style dependency specification from the named file
@@ -89,3 +127,47 @@ func (gcc *GccStyleCompiler) DefineExecutableArgs(exeName string) []string {
 	args[1] = exeName
 	return args
 }
+
+// Version runs the compiler to obtain its version number. gcc's
+// -dumpversion may only output the major version, -dumpfullversion
+// outputs all of it but is not understood by other compilers.
+func (gcc *GccStyleCompiler) Version() (string, error) {
+	args := []string{"-dumpversion"}
+	if GetCompilerFamily(gcc.command) == GccFamily {
+		args = []string{"-dumpfullversion", "-dumpversion"}
+	}
+	output, err := exec.Command(gcc.command, args...).Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// SystemIncludeDirs runs the compiler with the -E and -v options to
+// obtain its header file search list. Both C and C++ are probed as
+// the C++ search list includes the C++ library's directories. Not all
+// installations support C++ so only a failure to probe C is an error.
+func (gcc *GccStyleCompiler) SystemIncludeDirs() ([]string, error) {
+	probe := func(language string) ([]string, error) {
+		cmd := exec.Command(gcc.command, "-E", "-v", "-x", language, os.DevNull)
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return nil, err
+		}
+		return ParseIncludeSearchList(string(output)), nil
+	}
+	dirs, err := probe("c")
+	if err != nil {
+		return nil, err
+	}
+	if cppDirs, err := probe("c++"); err == nil {
+		seen := MakeStringSet(dirs...)
+		for _, dir := range cppDirs {
+			if !seen.Contains(dir) {
+				seen.Insert(dir)
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	return dirs, nil
+}
@@ -0,0 +1,150 @@
+// dcc - dependency-driven C/C++ compiler front end
+//
+// Copyright © A.Newman 2015.
+//
+// This source code is released under version 2 of the  GNU Public License.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// JUnit reports.
+//
+// With --junit dcc writes the results of the build to a file in the
+// JUnit XML format understood by many CI systems. Each source file
+// compiled, or not compiled as it is up to date, is a test case as is
+// the build's link step, if it has one. Failed actions include the
+// compiler, or linker, output. Up to date files, and a link step that
+// was not needed, are skipped test cases.
+//
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Output  string `xml:",cdata"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+// junitSeconds formats a duration as JUnit requires.
+//
+func junitSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// NewJUnitReport returns the JUnit report of a build.
+//
+func NewJUnitReport(report *BuildReport) *junitTestSuites {
+	suite := junitTestSuite{
+		Name:      "dcc",
+		Timestamp: report.StartTime().Format("2006-01-02T15:04:05"),
+		Time:      junitSeconds(time.Since(report.StartTime())),
+	}
+	add := func(tc junitTestCase) {
+		suite.Tests++
+		if tc.Failure != nil {
+			suite.Failures++
+		}
+		if tc.Skipped != nil {
+			suite.Skipped++
+		}
+		suite.Cases = append(suite.Cases, tc)
+	}
+
+	linked := false
+	failed := false
+	for _, a := range report.Actions() {
+		if a.Kind == ActionScan {
+			continue
+		}
+		tc := junitTestCase{
+			Name:      a.Source,
+			Classname: a.Kind,
+			Time:      junitSeconds(a.Duration()),
+		}
+		if a.Kind != ActionCompile {
+			tc.Name = a.Target
+			linked = true
+		}
+		if a.Skipped {
+			tc.Time = junitSeconds(0)
+			tc.Skipped = &junitSkipped{Message: a.Reason}
+		} else if a.Err != nil {
+			failed = true
+			tc.Failure = &junitFailure{
+				Message: a.FirstError(),
+				Output:  string(StripEscapes(a.Output)),
+			}
+		}
+		add(tc)
+	}
+
+	if kind, target := report.LinkStep(); kind != "" && !linked {
+		reason := "up to date"
+		if failed {
+			reason = "not done due to errors"
+		}
+		add(junitTestCase{
+			Name:      target,
+			Classname: kind,
+			Time:      junitSeconds(0),
+			Skipped:   &junitSkipped{Message: reason},
+		})
+	}
+
+	return &junitTestSuites{
+		Name:     suite.Name,
+		Tests:    suite.Tests,
+		Failures: suite.Failures,
+		Skipped:  suite.Skipped,
+		Time:     suite.Time,
+		Suites:   []junitTestSuite{suite},
+	}
+}
+
+// WriteJUnitReport writes the JUnit report of a build to a file.
+//
+func WriteJUnitReport(path string, report *BuildReport) error {
+	data, err := xml.MarshalIndent(NewJUnitReport(report), "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append([]byte(xml.Header), data...)
+	return ioutil.WriteFile(path, append(data, '\n'), 0666)
+}
@@ -9,7 +9,6 @@
 package main
 
 import (
-	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
@@ -30,14 +29,15 @@ func Link(target string, inputs []string, libs *Options, options *Options, other
 		args = append(args, endash(libs.Values)...)
 		args = append(args, frameworks...)
 		args = append(args, ActualCompiler.DefineExecutableArgs(target)...)
+		displayed := ""
 		if !Quiet {
 			if Verbose {
-				fmt.Fprintln(os.Stdout, ActualCompiler.Name(), strings.Join(args, " "))
+				displayed = ActualCompiler.Name() + " " + strings.Join(args, " ")
 			} else {
-				fmt.Fprintln(os.Stdout, "ld", target)
+				displayed = "ld " + target
 			}
 		}
-		return Exec(ActualCompiler.Name(), args, os.Stderr)
+		return RunAction(ActionLink, target, displayed, ActualCompiler.Name(), args)
 	}
 	if IgnoreDependencies {
 		return link()
@@ -0,0 +1,64 @@
+// dcc - dependency-driven C/C++ compiler front end
+//
+// Copyright © A.Newman 2015.
+//
+// This source code is released under version 2 of the  GNU Public License.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Lock files.
+//
+// Many dcc processes, run in parallel by make, may update the same
+// file. A lock file, a file alongside the file being updated, locked
+// using the operating system's file locking, flock(2) or LockFileEx,
+// serializes the updates. The lock is released when the holder closes
+// the file or exits, for whatever reason, so a process that dies while
+// holding a lock never leaves it behind. Lock files are not removed,
+// removing them would let another process lock a different file of
+// the same name.
+//
+
+const (
+	LockFileSuffix = ".lock"
+	lockRetryDelay = 10 * time.Millisecond
+	lockTimeout    = 2 * time.Minute
+)
+
+// LockFile acquires the lock file for the named file, waiting for
+// any other process holding it to release it. The returned function
+// releases the lock.
+//
+func LockFile(path string) (func(), error) {
+	lockPath := path + LockFileSuffix
+	file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		locked, err := tryLockFile(file)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%s: %w", lockPath, err)
+		}
+		if locked {
+			return func() {
+				unlockFile(file)
+				file.Close()
+			}, nil
+		}
+		if time.Now().After(deadline) {
+			file.Close()
+			return nil, fmt.Errorf("%s: timed out waiting for lock", lockPath)
+		}
+		time.Sleep(lockRetryDelay)
+	}
+}
@@ -57,6 +57,93 @@ var (
 	//
 	ActualCompiler Compiler
 
+	// CompilerFamily is the family, e.g. gcc or clang, of the
+	// compiler being used. It is used to find compiler-specific
+	// options files and by the !ifcompiler directive.
+	//
+	CompilerFamily = ""
+
+	// SkipSystemHeaders has dcc not check system header file
+	// dependencies and instead use the toolchain's modtime as
+	// a dependency.
+	//
+	// This is set by the --skip-system-headers command line option.
+	//
+	SkipSystemHeaders bool
+
+	// ReplayWarnings has dcc output the saved output of the last
+	// compilation of any object file that is up to date, so warnings
+	// are not lost when files are not re-compiled.
+	//
+	// This is set by the --replay-warnings command line option or
+	// the DCCREPLAYWARNINGS environment variable.
+	//
+	ReplayWarnings = os.Getenv("DCCREPLAYWARNINGS") != ""
+
+	// ColorDiagnostics has compilers that support it output colored
+	// diagnostics. Compiler output is captured by dcc and compilers
+	// will not output color themselves. dcc has them do so if its
+	// own standard error is a terminal.
+	//
+	ColorDiagnostics = IsTerminal(os.Stderr) && os.Getenv("NO_COLOR") == ""
+
+	// DedupDiagnostics has dcc output diagnostics reported by more
+	// than one source, i.e. those in header files, only once.
+	//
+	// This is set by the --dedup-diagnostics command line option or
+	// the DCCDEDUPDIAGNOSTICS environment variable.
+	//
+	DedupDiagnostics = os.Getenv("DCCDEDUPDIAGNOSTICS") != ""
+
+	// ShowSummary has dcc output the build summary for every build.
+	// Usually it is only output when the build compiles more than
+	// one source file or fails.
+	//
+	// This is set by the --summary command line option or the
+	// DCCSUMMARY environment variable.
+	//
+	ShowSummary = os.Getenv("DCCSUMMARY") != ""
+
+	// MaxErrors is the number of compiler errors after which dcc
+	// stops compiling. Zero means no limit.
+	//
+	// This is set by the --max-errors command line option.
+	//
+	MaxErrors = 0
+
+	// Status displays the commands being run, on a single updating
+	// line if our output is a terminal (status.go).
+	//
+	Status = NewStatusLine(os.Stdout, Getenv("DCC_STATUS", DefaultStatusFormat))
+
+	// Report records the actions performed by the build and is
+	// used to output a summary when the build ends (report.go).
+	//
+	Report = NewBuildReport()
+
+	// Diagnostics collects the diagnostics output by the compiler,
+	// from both the files compiled and the saved output of those
+	// that are up to date. It is nil unless something needs the
+	// diagnostics, e.g. a warning baseline is being used.
+	//
+	Diagnostics *DiagnosticSet
+
+	// Events is the build event stream written when --events is
+	// used (events.go). It is nil if events are not being written.
+	//
+	Events *EventStream
+
+	// Daemon is used to talk to the dcc daemon (daemon.go) if one
+	// is running. It is nil if there is no daemon.
+	//
+	Daemon *DaemonClient
+
+	// ActualToolchain describes the actual compiler's toolchain
+	// (toolchain.go). It is only set when system headers are
+	// being skipped.
+	//
+	ActualToolchain *Toolchain
+
 	// DefaultNumJobs is the number of concurrent compilations
 	// dcc will perform by default.  The "2 + numcpu" is the
 	// same value used by the ninja build tool.
@@ -136,6 +223,17 @@ var (
 	//
 	LDFLAGSFILE = Getenv("LDFLAGSFILE", "LDFLAGS")
 
+	// IncludePath is the list of directories searched for files
+	// included by options files. It is set from the DCCINCLUDE
+	// environment variable.
+	//
+	IncludePath = filepath.SplitList(os.Getenv("DCCINCLUDE"))
+
+	// MaxIncludeDepth limits the nesting of included options
+	// files.
+	//
+	MaxIncludeDepth = 64
+
 	// LIBSFILE is the name of the "options file" that defines
 	// the names of the libraries used when linking.
 	//
@@ -172,12 +270,73 @@ func main() {
 		defer CatchPanics()
 	}
 
+	// Watch mode runs dcc, as if --watch was not supplied, again
+	// and again.
+	//
+	for i := 1; i < len(os.Args); i++ {
+		if os.Args[i] == "--watch" {
+			args := append(append([]string{}, os.Args[1:i]...), os.Args[i+1:]...)
+			if err := Watch(args); err != nil {
+				log.Fatal(err)
+			}
+			os.Exit(0)
+		}
+	}
+
+	// Running as the daemon is a completely separate thing.
+	//
+	if len(os.Args) > 1 && os.Args[1] == "--daemon" {
+		if err := RunDaemon(DaemonSocketPath()); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	// As is merging compile_commands.json files.
+	//
+	if len(os.Args) > 1 && os.Args[1] == "--merge-compile-commands" {
+		output, dirs := CompileCommandsFilename, os.Args[2:]
+		if len(dirs) > 1 && dirs[0] == "-o" {
+			output, dirs = dirs[1], dirs[2:]
+		}
+		if len(dirs) == 0 {
+			UsageError(os.Stderr, 1)
+		}
+		if err := MergeCompileCommands(output, dirs); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
 	runningMode := ModeNotSpecified
 	outputPathname := ""
 	dasho := ""
 	dashm := ""
 	writeCompileCommands := false
 	appendCompileCommands := false
+	useDaemon := true
+	warningBaseline := ""
+	updateWarningBaseline := false
+	sarifFile := ""
+	diagnosticsFile := ""
+	traceFile := ""
+	junitFile := ""
+	eventsName := ""
+
+	// Variables defined on the command line, via --define, are
+	// used by the options files so must be known before we read
+	// them.
+	//
+	for i := 1; i < len(os.Args); i++ {
+		if os.Args[i] == "--define" {
+			if i++; i == len(os.Args) {
+				log.Fatal("--define: NAME=VALUE required")
+			}
+			if err := Define(os.Args[i]); err != nil {
+				log.Fatalf("--define: %s", err)
+			}
+		}
+	}
 
 	cCompiler := makeCompilerOption(CCFILE, platform.DefaultCC)
 	cppCompiler := makeCompilerOption(CXXFILE, platform.DefaultCXX)
@@ -204,6 +363,10 @@ func main() {
 				cplusplus()
 				break
 			}
+			if os.Args[i] == "--define" {
+				i++
+				continue
+			}
 			if os.Args[i][0] != '-' && IsCPlusPlusFile(os.Args[i]) {
 				cplusplus()
 				break
@@ -235,6 +398,32 @@ func main() {
 	//
 	libraryDirs = append(libraryDirs, platform.LibraryPaths...)
 
+	// The compiler's family determines which compiler-specific
+	// options files are used so it must be known before we read
+	// them.
+	//
+	CompilerFamily = GetCompilerFamily(underlyingCompiler.String())
+	if Debug {
+		log.Printf("DEBUG: compiler %q is a %s compiler", underlyingCompiler.String(), CompilerFamily)
+	}
+
+	// Options files may use dcc's built-in variables (builtins.go)
+	// which describe the build we're about to do. We've not yet
+	// interpreted the command line so we have a quick look at it.
+	//
+	mode, output, objdirName := PrescanArgs(os.Args[1:])
+	SetBuiltin(BuiltinCompiler, CompilerFamily)
+	SetBuiltin(BuiltinMode, mode)
+	SetBuiltin(BuiltinOutput, output)
+	SetBuiltin(BuiltinObjdir, objdirName)
+	SetLazyBuiltin(BuiltinCompilerVersion, func() string {
+		version, err := GetCompiler(underlyingCompiler.String()).Version()
+		if err != nil {
+			log.Printf("warning: %s: %s", BuiltinCompilerVersion, err)
+		}
+		return version
+	})
+
 	// Get compiler options from the options file.
 	//
 	if path, found := FindFile(optionsFilename); found {
@@ -394,6 +583,75 @@ func main() {
 		case arg == "--force":
 			IgnoreDependencies = true
 
+		case arg == "--skip-system-headers":
+			SkipSystemHeaders = true
+
+		case arg == "--no-daemon":
+			useDaemon = false
+
+		case arg == "--replay-warnings":
+			ReplayWarnings = true
+
+		case arg == "--dedup-diagnostics":
+			DedupDiagnostics = true
+
+		case arg == "--summary":
+			ShowSummary = true
+
+		case arg == "--max-errors":
+			if i++; i >= len(os.Args) {
+				log.Fatalf("%s: number of errors required", arg)
+			} else if n, err := strconv.Atoi(os.Args[i]); err != nil || n < 0 {
+				log.Fatalf("%s: invalid number of errors %q", arg, os.Args[i])
+			} else {
+				MaxErrors = n
+			}
+
+		case arg == "--warning-baseline":
+			if i++; i < len(os.Args) {
+				warningBaseline = os.Args[i]
+			} else {
+				log.Fatalf("%s: baseline filename required", arg)
+			}
+
+		case arg == "--update-warning-baseline":
+			updateWarningBaseline = true
+
+		case arg == "--sarif":
+			if i++; i < len(os.Args) {
+				sarifFile = os.Args[i]
+			} else {
+				log.Fatalf("%s: SARIF filename required", arg)
+			}
+
+		case arg == "--trace":
+			if i++; i < len(os.Args) {
+				traceFile = os.Args[i]
+			} else {
+				log.Fatalf("%s: trace filename required", arg)
+			}
+
+		case arg == "--junit":
+			if i++; i < len(os.Args) {
+				junitFile = os.Args[i]
+			} else {
+				log.Fatalf("%s: JUnit report filename required", arg)
+			}
+
+		case arg == "--events":
+			if i++; i < len(os.Args) {
+				eventsName = os.Args[i]
+			} else {
+				log.Fatalf("%s: file descriptor or filename required", arg)
+			}
+
+		case arg == "--diagnostics-json":
+			if i++; i < len(os.Args) {
+				diagnosticsFile = os.Args[i]
+			} else {
+				log.Fatalf("%s: filename required", arg)
+			}
+
 		case arg == "--quiet":
 			Quiet = true
 
@@ -418,6 +676,9 @@ func main() {
 				NumJobs = n
 			}
 
+		case arg == "--define":
+			i++ // handled above
+
 		case arg == "--objdir":
 			if i++; i < len(os.Args) {
 				ObjsDir = os.Args[i]
@@ -655,22 +916,147 @@ func main() {
 	//
 	ActualCompiler = GetCompiler(underlyingCompiler.String())
 
+	// If we're skipping system headers we need to know what they
+	// are and the toolchain they belong to. If we can't find out
+	// we check all dependencies.
+	//
+	if SkipSystemHeaders {
+		ActualToolchain, err = LoadToolchain(ActualCompiler, ToolchainCacheFilename(objdir, ActualCompiler))
+		if err != nil {
+			log.Printf("warning: unable to determine system header directories: %s", err)
+			SkipSystemHeaders = false
+		}
+	}
+
+	// When our output is a terminal commands are displayed on a
+	// status line. Anything else written to the terminal must
+	// go via the status line.
+	//
+	if IsTerminal(os.Stdout) && !Verbose && !Quiet {
+		Status.EnableUpdates()
+		log.SetOutput(Status.Writer(os.Stderr))
+	}
+
+	// With --events we describe what we're doing, as we do it, to
+	// some other program (events.go).
+	//
+	// From here on fatal errors go via Fatal, and exits via Exit, so
+	// the stream always ends with the build_finished event.
+	//
+	if eventsName != "" {
+		stream, err := OpenEventStream(eventsName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		Events = stream
+		Events.BuildStarted(os.Args[1:], DccCurrentDirectory)
+		Events.OptionsResolved(underlyingCompiler, compilerOptions, linkerOptions, libraryFiles)
+		Report.AddObserver(Events)
+	}
+
+	// The warning baseline and structured diagnostics output need
+	// the compiler's diagnostics.
+	//
+	if updateWarningBaseline && warningBaseline == "" {
+		Fatal("--update-warning-baseline: no baseline file, use --warning-baseline")
+	}
+	if warningBaseline != "" || sarifFile != "" || diagnosticsFile != "" {
+		Diagnostics = new(DiagnosticSet)
+	}
+
+	// Talk to the daemon if there is one.
+	//
+	if useDaemon && !IgnoreDependencies {
+		Daemon = ConnectDaemon(DaemonSocketPath())
+	}
+
 	// Generate a compile_commands.json if requested.
 	//
 	if appendCompileCommands {
 		if err := AppendCompileCommandsDotJson(filepath.Join(objdir, CompileCommandsFilename), sourceFilenames, compilerOptions, objdir); err != nil {
-			log.Fatal(err)
+			Fatal(err)
 		}
 	} else if writeCompileCommands {
 		if err := WriteCompileCommandsDotJson(filepath.Join(objdir, CompileCommandsFilename), sourceFilenames, compilerOptions, objdir); err != nil {
-			log.Fatal(err)
+			Fatal(err)
+		}
+	}
+
+	// The build report (report.go) needs to know about any link
+	// step so it can report if it was done or not.
+	//
+	switch runningMode {
+	case CompileAndLink:
+		target := outputPathname
+		if target == "" {
+			target = platform.DefaultExecutable
+		}
+		Report.SetLinkStep(ActionLink, target)
+	case CompileAndMakeDLL:
+		Report.SetLinkStep(ActionDll, outputPathname)
+	case CompileAndMakePlugin:
+		Report.SetLinkStep(ActionPlugin, outputPathname)
+	case CompileAndMakeLib:
+		Report.SetLinkStep(ActionLib, outputPathname)
+	}
+
+	// The build ends by summarizing what was done and writing
+	// any requested reports.
+	//
+	finish := func(status int) {
+		Status.Done()
+		writeSummary(len(sourceFilenames), status != 0)
+		if traceFile != "" {
+			if err := WriteTrace(traceFile, Report); err != nil {
+				log.Print(err)
+				status = 1
+			}
+		}
+		if junitFile != "" {
+			if err := WriteJUnitReport(junitFile, Report); err != nil {
+				log.Print(err)
+				status = 1
+			}
 		}
+		Exit(status)
 	}
 
 	// And now we're ready to compile everything.
 	//
-	if !CompileAll(sourceFilenames, compilerOptions, objdir) {
-		os.Exit(1)
+	compiledOk := CompileAll(sourceFilenames, compilerOptions, objdir)
+
+	// In watch mode we tell the watcher what to watch.
+	//
+	writeBuildInputs(
+		sourceFilenames,
+		objdir,
+		[]*Options{underlyingCompiler, compilerOptions, linkerOptions, libraryFiles},
+		libraryFiles.Values,
+		otherFiles.Values,
+	)
+
+	// Write the diagnostics, if requested. This is done regardless
+	// of errors as it's the errors people want to see.
+	//
+	if sarifFile != "" {
+		if err := WriteSARIF(sarifFile, Diagnostics.Items()); err != nil {
+			Fatal(err)
+		}
+	}
+	if diagnosticsFile != "" {
+		if err := WriteDiagnosticsJSON(diagnosticsFile, Diagnostics.Items()); err != nil {
+			Fatal(err)
+		}
+	}
+
+	if !compiledOk {
+		finish(1)
+	}
+
+	// Check, or update, the warning baseline.
+	//
+	if warningBaseline != "" && !checkWarningBaseline(warningBaseline, updateWarningBaseline) {
+		finish(1)
 	}
 
 	// Then, if required, link an executable or DLL, or create a
@@ -693,13 +1079,17 @@ func main() {
 		err = Lib(outputPathname, inputFilenames)
 	}
 
+	if err == nil {
+		Report.SkipLinkStep("up to date")
+	}
+
 	// And that's it. Report any final error and exit.
 	//
 	if err != nil {
 		log.Print(err)
-		os.Exit(1)
+		finish(1)
 	}
-	os.Exit(0)
+	finish(0)
 }
 
 // Helper function to create an Options (see options.go) that
@@ -753,8 +1143,40 @@ Options:
     -j[N]           Use 'N' compile jobs (note single dash, default is one per CPU).
     --cpp	    Compile source files as C++.
     --force         Ignore dependencies, always compile/link/lib.
+    --watch         Build, then re-build whenever any input changes.
+    --skip-system-headers
+                    Don't check system header dependencies, use
+                    the toolchain's modtime instead.
     --clean         Remove dcc-maintained files.
+    --replay-warnings
+                    Output the saved warnings of files that are
+                    up to date.
+    --dedup-diagnostics
+                    Output diagnostics reported by many sources,
+                    e.g. in header files, once.
+    --max-errors N  Stop compiling after N errors.
+    --warning-baseline path
+                    Fail if there are any warnings not listed in
+                    the warning baseline file 'path'.
+    --update-warning-baseline
+                    Write the current warnings to the warning
+                    baseline file.
+    --sarif path    Write the compiler's diagnostics to the SARIF file 'path'.
+    --trace path    Write a Chrome trace of the build to 'path'.
+    --junit path    Write a JUnit XML report of the build to 'path'.
+    --events fd|path
+                    Write a stream of JSON build events to the file
+                    descriptor 'fd' or file 'path'.
+    --diagnostics-json path
+                    Write the compiler's diagnostics to 'path' as
+                    JSON lines.
+    --define NAME=VALUE
+                    Define a variable for use in options files.
+    --daemon        Run the dcc daemon (must be the first option).
+    --no-daemon     Don't use the dcc daemon.
     --quiet         Disable non-error messages.
+    --summary       Output the build summary even when only one
+                    source file is compiled and the build succeeds.
     --verbose       Show more output.
     --debug         Enable debug messages.
     --version       Report dcc version and exit.
@@ -763,6 +1185,10 @@ Options:
     --append-compile-commands
                     Append to an existng compile_commands.json file
 		    if it exists.
+    --merge-compile-commands [-o path] dir...
+                    Merge the compile_commands.json files found in
+                    the directories into one file, 'path' or
+                    compile_commands.json (must be the first option).
 
 With anything else is passed to the underlying compiler.
 
@@ -772,6 +1198,13 @@ Environment
     DEPSDIR	    Name of .d file directory (%s).
     OBJDIR	    Name of .o file directory (%s).
     DCCDIR	    Name of the dcc-options directory (%s).
+    DCCDAEMON       Pathname of the dcc daemon's socket.
+    DCCINCLUDE      Directories searched for !include'd files.
+    DCCREPLAYWARNINGS
+                    If set, as if --replay-warnings was supplied.
+    DCCDEDUPDIAGNOSTICS
+                    If set, as if --dedup-diagnostics was supplied.
+    DCC_STATUS      Format of the status line.
     NJOBS           Number of compile jobs (%d).
 
 The following variables define the actual names used for
@@ -840,10 +1273,37 @@ func CatchPanics() {
 		} else {
 			fmt.Fprintf(os.Stderr, "PANIC: %v\n", x)
 		}
-		os.Exit(1)
+		Exit(1)
 	}
 }
 
+// Exit exits dcc with the given status. If build events are being
+// written the build_finished event is emitted first so whatever is
+// reading the events always sees the build end.
+//
+func Exit(status int) {
+	if Events != nil {
+		Events.BuildFinished(status)
+	}
+	os.Exit(status)
+}
+
+// Fatal is the equivalent of log.Fatal for use once the build has
+// started. It logs its arguments and exits via Exit.
+//
+func Fatal(v ...interface{}) {
+	log.Print(v...)
+	Exit(1)
+}
+
+// Fatalf is the equivalent of log.Fatalf for use once the build
+// has started.
+//
+func Fatalf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+	Exit(1)
+}
+
 func readLibs(libsFile string, libraryFiles *Options, libraryDirs *[]string, frameworks *[]string) error {
 	var frameworkDirs []string
 	captureNext := false
@@ -94,7 +94,7 @@ func ConfigureLogger(prefix string) {
 func MustGetwd() string {
 	s, err := os.Getwd()
 	if err != nil {
-		log.Fatal(err)
+		Fatal(err)
 	}
 	return s
 }
@@ -17,6 +17,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
 )
 
@@ -41,6 +42,21 @@ func msvcScrapeShowIncludes(r io.Reader, deps io.Writer, nonDeps io.Writer, sour
 	}
 }
 
+// CompileCommand returns the command line used to compile a source
+// file, less the /showIncludes option used to obtain dependencies.
+func (cl *msvcCompiler) CompileCommand(source, object string, options []string) []string {
+	return append([]string{cl.Name()}, cl.compileArgs(source, object, options, nil)...)
+}
+
+// compileArgs returns the arguments passed to cl.exe to compile a
+// source file. The extra options follow the user's options.
+func (cl *msvcCompiler) compileArgs(source, object string, options []string, extra []string) []string {
+	args := append([]string{}, options...)
+	args = append(args, "/nologo")
+	args = append(args, extra...)
+	return append(args, "/c", source, "/Fo"+object)
+}
+
 func (cl *msvcCompiler) Compile(source, object, deps string, options []string, stderr io.Writer) error {
 	r, w, err := os.Pipe()
 	if err != nil {
@@ -56,13 +72,22 @@ func (cl *msvcCompiler) Compile(source, object, deps string, options []string, s
 
 	fmt.Fprintln(depsFile, object)
 
-	go msvcScrapeShowIncludes(r, depsFile, os.Stdout, filepath.Base(source))
-
-	args := append([]string{}, options...)
-	args = append(args, "/nologo", "/showIncludes", "/c", source, "/Fo"+object)
+	scraped := make(chan struct{})
+	go func() {
+		msvcScrapeShowIncludes(r, depsFile, stderr, filepath.Base(source))
+		close(scraped)
+	}()
+
+	// cl.exe's standard output and standard error both go to the
+	// pipe so its output, less the /showIncludes notes, is kept in
+	// the order it was written.
+	//
+	args := cl.compileArgs(source, object, options, []string{"/showIncludes"})
 	cmd := exec.Command(cl.Name(), args...)
-	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, w, stderr
-	err = cmd.Run()
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, w, w
+	err = run(cmd)
+	w.Close()
+	<-scraped
 	err2 := depsFile.Close()
 	if err != nil {
 		os.Remove(deps)
@@ -108,3 +133,27 @@ func (cl *msvcCompiler) DefineExecutableArgs(exeName string) []string {
 	args[0] = fmt.Sprintf("/Fe%s", exeName)
 	return args
 }
+
+// Version runs cl.exe, without arguments, to obtain its version
+// number from the banner it outputs.
+func (cl *msvcCompiler) Version() (string, error) {
+	output, _ := exec.Command(cl.Name()).CombinedOutput()
+	if match := msvcVersion.FindSubmatch(output); match != nil {
+		return string(match[1]), nil
+	}
+	return "", fmt.Errorf("%s: unable to determine version", cl.Name())
+}
+
+var msvcVersion = regexp.MustCompile(`Version ([0-9]+(\.[0-9]+)+)`)
+
+// SystemIncludeDirs returns the directories named by the INCLUDE
+// environment variable, which is how cl.exe locates system headers.
+func (cl *msvcCompiler) SystemIncludeDirs() ([]string, error) {
+	var dirs []string
+	for _, dir := range filepath.SplitList(os.Getenv("INCLUDE")) {
+		if dir != "" {
+			dirs = append(dirs, filepath.Clean(dir))
+		}
+	}
+	return dirs, nil
+}
@@ -20,13 +20,20 @@ import (
 )
 
 const (
-	includeDirective = "!include"
-	inheritDirective = "!inherit"
-	ifdefDirective   = "!ifdef"
-	ifndefDirective  = "!ifndef"
-	elseDirective    = "!else"
-	endifDirective   = "!endif"
-	errorDirective   = "!error"
+	includeDirective         = "!include"
+	includeOnceDirective     = "!include-once"
+	includeOptionalDirective = "!include-optional"
+	inheritDirective         = "!inherit"
+	ifdefDirective           = "!ifdef"
+	ifndefDirective          = "!ifndef"
+	ifDirective              = "!if"
+	ifcompilerDirective      = "!ifcompiler"
+	elifDirective            = "!elif"
+	elseDirective            = "!else"
+	endifDirective           = "!endif"
+	errorDirective           = "!error"
+	setDirective             = "!set"
+	setDefaultDirective      = "!set-default"
 )
 
 // Options represents a series of words and is used to represent
@@ -36,10 +43,13 @@ const (
 // An Options has a slice of strings, the option "values".
 //
 type Options struct {
-	Values   []string    // option values
-	Path     string      // associated file path
-	fileinfo os.FileInfo // actual options file info
-	mtime    time.Time   // options modtime, mutable
+	Values    []string       // option values
+	Path      string         // associated file path
+	Files     []string       // all files read, including any !include'd
+	fileinfo  os.FileInfo    // actual options file info
+	scope     *VariableScope // variables of the file being read
+	including []string       // the files being read, outermost first
+	mtime     time.Time      // options modtime, mutable
 }
 
 // NewOptions returns a new, empty, Options value
@@ -149,12 +159,17 @@ func (o *Options) ReadFromFile(filename string, filter func(string) string) (boo
 	}
 	defer file.Close()
 	o.Path = filename
+	o.Files = append(o.Files, filename)
 	info, err := file.Stat()
 	if err != nil {
 		return true, err
 	}
 	o.fileinfo = info
-	o.SetModTime(info.ModTime())
+	if info.ModTime().After(o.mtime) {
+		o.SetModTime(info.ModTime()) // an included file may be older
+	}
+	o.including = append(o.including, filename)
+	defer func() { o.including = o.including[:len(o.including)-1] }()
 	return o.ReadFromReader(file, filename, filter)
 }
 
@@ -164,6 +179,15 @@ func (o *Options) ReadFromReader(r io.Reader, filename string, filter func(strin
 	if filter == nil {
 		filter = func(s string) string { return s }
 	}
+	scope := NewVariableScope(o.scope)
+	o.scope = scope
+	defer func() { o.scope = scope.parent }()
+	lookup := func(name string) (string, bool) {
+		return LookupVariable(name, filename, scope)
+	}
+	lookupWords := func(name string) ([]string, bool) {
+		return LookupVariableWords(name, filename, scope)
+	}
 	var conditional Conditional
 	input := bufio.NewScanner(r)
 	lineNumber := 0
@@ -180,23 +204,6 @@ func (o *Options) ReadFromReader(r io.Reader, filename string, filter func(strin
 			continue
 		}
 
-		evalCondition := func(invert bool) error {
-			if len(fields) != 2 {
-				return reportErrorInFile(filename, lineNumber, fmt.Sprintf("%s requires a single parameter", fields[0]))
-			}
-			val := os.Getenv(fields[1])
-			state1, state2 := TrueConditionState, FalseConditionState
-			if invert {
-				state1, state2 = FalseConditionState, TrueConditionState
-			}
-			if val != "" {
-				conditional.PushState(state1)
-			} else {
-				conditional.PushState(state2)
-			}
-			return nil
-		}
-
 		if fields[0] == errorDirective {
 			if !conditional.IsSkippingLines() {
 				message := strings.Join(fields[1:], " ")
@@ -208,40 +215,67 @@ func (o *Options) ReadFromReader(r io.Reader, filename string, filter func(strin
 			continue
 		}
 
-		if fields[0] == ifdefDirective {
-			if conditional.IsSkippingLines() {
-				conditional.PushState(conditional.CurrentState())
-			} else if err := evalCondition(false); err != nil {
-				return false, err
-			} else {
-				continue
+		// !ifdef <envvar>, !ifndef <envvar>, !if <expr>,
+		// !ifcompiler <family>... and !elif <expr>. Conditions
+		// are only evaluated if needed.
+		//
+		evalCondition := func() (bool, error) {
+			if !conditional.NeedsCondition(fields[0] == elifDirective) {
+				return false, nil
+			}
+			switch fields[0] {
+			case ifdefDirective, ifndefDirective:
+				if len(fields) != 2 {
+					return false, reportErrorInFile(filename, lineNumber, fmt.Sprintf("%s requires a single parameter", fields[0]))
+				}
+				value, _ := lookup(fields[1])
+				defined := value != ""
+				return defined == (fields[0] == ifdefDirective), nil
+			case ifcompilerDirective:
+				if len(fields) < 2 {
+					return false, reportErrorInFile(filename, lineNumber, fmt.Sprintf("%s requires one or more compiler families", fields[0]))
+				}
+				for _, family := range fields[1:] {
+					if CompilerFamily != "" && family == CompilerFamily {
+						return true, nil
+					}
+				}
+				return false, nil
+			default:
+				expr := strings.TrimSpace(line)[len(fields[0]):]
+				result, err := EvalExpr(expr, lookupWords)
+				if err != nil {
+					return false, reportErrorInFile(filename, lineNumber, fmt.Sprintf("%s: %s", fields[0], err))
+				}
+				return result, nil
 			}
 		}
 
-		if fields[0] == ifndefDirective {
-			if conditional.IsSkippingLines() {
-				conditional.PushState(conditional.CurrentState())
-			} else if err := evalCondition(true); err != nil {
+		switch fields[0] {
+		case ifdefDirective, ifndefDirective, ifDirective, ifcompilerDirective:
+			condition, err := evalCondition()
+			if err != nil {
 				return false, err
-			} else {
-				continue
 			}
-		}
-
-		if fields[0] == elseDirective {
-			if !conditional.IsActive() {
-				return false, reportErrorInFile(filename, lineNumber, ErrNoCondition.Error())
+			conditional.If(condition, lineNumber)
+			continue
+		case elifDirective:
+			condition, err := evalCondition()
+			if err != nil {
+				return false, err
+			}
+			if err := conditional.Elif(condition); err != nil {
+				return false, reportErrorInFile(filename, lineNumber, err.Error())
 			}
-			conditional.ToggleState()
 			continue
-		}
-
-		if fields[0] == endifDirective {
-			if !conditional.IsActive() {
-				return false, reportErrorInFile(filename, lineNumber, ErrNoCondition.Error())
+		case elseDirective:
+			if err := conditional.Else(); err != nil {
+				return false, reportErrorInFile(filename, lineNumber, err.Error())
 			}
-			if err := conditional.PopState(); err != nil {
-				return false, err
+			continue
+		case endifDirective:
+			if err := conditional.Endif(); err != nil {
+				return false, reportErrorInFile(filename, lineNumber, err.Error())
 			}
 			continue
 		}
@@ -250,10 +284,20 @@ func (o *Options) ReadFromReader(r io.Reader, filename string, filter func(strin
 			continue
 		}
 
-		// !include <filename>
+		// !set <name>=<value> and !set-default <name>=<value>
 		//
-		if fields[0] == includeDirective {
-			if err := o.includeFile(filename, lineNumber, line, fields, filter); err != nil {
+		if fields[0] == setDirective || fields[0] == setDefaultDirective {
+			if err := o.setVariable(filename, lineNumber, line, fields[0], lookupWords); err != nil {
+				return false, err
+			}
+			continue
+		}
+
+		// !include <filename>, !include-once <filename> and
+		// !include-optional <filename>
+		//
+		if fields[0] == includeDirective || fields[0] == includeOnceDirective || fields[0] == includeOptionalDirective {
+			if err := o.includeFile(filename, lineNumber, line, fields[0], lookupWords, filter); err != nil {
 				return false, err
 			}
 			continue
@@ -268,19 +312,22 @@ func (o *Options) ReadFromReader(r io.Reader, filename string, filter func(strin
 			continue
 		}
 
-		// Otherwise, treat fields (tokens) as options to be included.
-		// Expand (interpolate) any variable references, filter and
-		// collect any non-empty strings.
-		for _, field := range fields {
-			field = os.ExpandEnv(field)
-			fields2 := strings.Fields(field)
-			for _, field2 := range fields2 {
-				if field2 = filter(field2); field2 != "" {
-					o.Values = append(o.Values, field2)
-				}
+		// Otherwise, split the line into words (words.go),
+		// expanding any variable references, filter and collect
+		// any non-empty strings.
+		words, err := SplitWords(line, lookupWords)
+		if err != nil {
+			return false, reportErrorInFile(filename, lineNumber, err.Error())
+		}
+		for _, word := range words {
+			if word = filter(word); word != "" {
+				o.Values = append(o.Values, word)
 			}
 		}
 	}
+	if conditional.IsActive() {
+		return false, reportErrorInFile(filename, conditional.StartLine(), "conditional section has no !endif")
+	}
 	return true, nil
 }
 
@@ -305,23 +352,144 @@ func malformedLine(filename string, lineNumber int, what, line string) error {
 	return reportErrorInFile(filename, lineNumber, fmt.Sprintf("malformed %s - %s", what, line))
 }
 
-func (o *Options) includeFile(parentFilename string, lineNumber int, line string, fields []string, filter func(string) string) error {
-	if len(fields) != 2 {
-		return malformedLine(parentFilename, lineNumber, includeDirective, line)
+// setVariable interprets a !set or !set-default directive and sets
+// the variable in the scope of the file being read. The value is the
+// words of the remainder of the line, after the '='.
+//
+func (o *Options) setVariable(filename string, lineNumber int, line, directive string, lookup func(string) ([]string, bool)) error {
+	definition := strings.TrimSpace(strings.TrimSpace(line)[len(directive):])
+	index := strings.IndexByte(definition, '=')
+	if index == -1 {
+		return malformedLine(filename, lineNumber, directive, line)
 	}
-	Assert(fields[1] != "", "unexpected empty field returned from strings.Fields()")
-	filename := fields[1]
-	if filename[0] == '"' {
-		filename = RemoveDelimiters(filename, '"', '"')
-	} else if filename[0] == '<' {
-		filename = RemoveDelimiters(filename, '<', '>')
+	name := strings.TrimSpace(definition[:index])
+	if !IsVariableName(name) {
+		return reportErrorInFile(filename, lineNumber, fmt.Sprintf("%s: %q is not a valid variable name", directive, name))
 	}
-	path := filepath.Join(filepath.Dir(parentFilename), filename)
-	if Debug {
-		log.Printf("DEBUG: %q including %q", parentFilename, path)
+	if directive == setDefaultDirective {
+		if _, defined := lookup(name); defined {
+			return nil
+		}
+	}
+	words, err := SplitWords(definition[index+1:], lookup)
+	if err != nil {
+		return reportErrorInFile(filename, lineNumber, err.Error())
+	}
+	o.scope.Set(name, words)
+	return nil
+}
+
+// includeFile interprets the !include, !include-once and
+// !include-optional directives. The file to be included may be
+// named using a glob pattern, e.g. flags.d/*.opt, in which case all
+// the matching files are included, in order. Files are searched for
+// in the directory of the including file and then on the IncludePath.
+// A file named within angle brackets, <filename>, is searched for on
+// the IncludePath first.
+//
+func (o *Options) includeFile(parentFilename string, lineNumber int, line, directive string, lookup func(string) ([]string, bool), filter func(string) string) error {
+	arg := strings.TrimSpace(strings.TrimSpace(line)[len(directive):])
+	var filename string
+	dirs := append([]string{filepath.Dir(parentFilename)}, IncludePath...)
+	if len(arg) > 2 && arg[0] == '<' && arg[len(arg)-1] == '>' {
+		filename = RemoveDelimiters(arg, '<', '>')
+		dirs = append(append([]string{}, IncludePath...), filepath.Dir(parentFilename))
+	} else if words, err := SplitWords(arg, lookup); err != nil {
+		return reportErrorInFile(parentFilename, lineNumber, err.Error())
+	} else if len(words) != 1 || words[0] == "" {
+		return malformedLine(parentFilename, lineNumber, directive, line)
+	} else {
+		filename = words[0]
+	}
+	if filepath.IsAbs(filename) {
+		dirs = []string{""}
+	}
+
+	paths, err := findIncludedFiles(filename, dirs)
+	if err != nil {
+		return reportErrorInFile(parentFilename, lineNumber, err.Error())
+	}
+	if len(paths) == 0 {
+		if directive == includeOptionalDirective || isGlobPattern(filename) {
+			if Debug {
+				log.Printf("DEBUG: %q: nothing to include for %q", parentFilename, filename)
+			}
+			return nil
+		}
+		return reportErrorInFile(parentFilename, lineNumber, fmt.Sprintf("included file %q not found", filename))
 	}
-	_, err := o.ReadFromFile(path, filter)
-	return err
+
+	for _, path := range paths {
+		if directive == includeOnceDirective && o.hasRead(path) {
+			continue
+		}
+		if err := o.checkInclude(parentFilename, lineNumber, path); err != nil {
+			return err
+		}
+		if Debug {
+			log.Printf("DEBUG: %q including %q", parentFilename, path)
+		}
+		if _, err := o.ReadFromFile(path, filter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findIncludedFiles returns the paths of the files named by filename,
+// possibly a glob pattern, found in the first of the directories to
+// contain any.
+//
+func findIncludedFiles(filename string, dirs []string) ([]string, error) {
+	for _, dir := range dirs {
+		path := filepath.Join(dir, filename)
+		if isGlobPattern(filename) {
+			matches, err := filepath.Glob(path)
+			if err != nil {
+				return nil, fmt.Errorf("%q: %s", filename, err)
+			}
+			if len(matches) > 0 {
+				return matches, nil
+			}
+		} else if _, err := Stat(path); err == nil {
+			return []string{path}, nil
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+func isGlobPattern(filename string) bool {
+	return strings.ContainsAny(filename, "*?[")
+}
+
+// hasRead returns true if the receiver has read the named file.
+//
+func (o *Options) hasRead(path string) bool {
+	for _, filename := range o.Files {
+		if absPath(filename) == absPath(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkInclude returns an error if reading the file named by path
+// would create a cycle, a file including itself directly or
+// indirectly, or the files being read are nested too deeply.
+//
+func (o *Options) checkInclude(parentFilename string, lineNumber int, path string) error {
+	for index, filename := range o.including {
+		if absPath(filename) == absPath(path) {
+			chain := append(append([]string{}, o.including[index:]...), path)
+			return reportErrorInFile(parentFilename, lineNumber, "include cycle: "+strings.Join(chain, " -> "))
+		}
+	}
+	if len(o.including) >= MaxIncludeDepth {
+		return reportErrorInFile(parentFilename, lineNumber, fmt.Sprintf("includes nested more than %d deep", MaxIncludeDepth))
+	}
+	return nil
 }
 
 func (o *Options) inheritFile(parentFilename string, lineNumber int, line string, fields []string, filter func(string) string) error {
@@ -347,6 +515,10 @@ func (o *Options) inheritFile(parentFilename string, lineNumber int, line string
 		log.Printf("DEBUG: %q inheriting %q", parentFilename, path)
 	}
 
+	if err := o.checkInclude(parentFilename, lineNumber, path); err != nil {
+		return err
+	}
+
 	ok, err := o.ReadFromFile(path, filter)
 	if err != nil {
 		return err
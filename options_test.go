@@ -15,6 +15,7 @@ import (
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 )
 
 func expectValues(t *testing.T, options *Options, expectedValues []string) {
@@ -91,13 +92,43 @@ $AVAR $BVAR
 	testOptions(t, data, []string{"a-var-value"})
 
 	os.Setenv("AVAR", "value1 value2")
-	testOptions(t, data, []string{"value1", "value2"})
+	testOptions(t, data, []string{"value1 value2"})
 
 	os.Setenv("BVAR", "")
-	testOptions(t, data, []string{"value1", "value2"})
+	testOptions(t, data, []string{"value1 value2"})
 
 	os.Setenv("BVAR", "value3")
-	testOptions(t, data, []string{"value1", "value2", "value3"})
+	testOptions(t, data, []string{"value1 value2", "value3"})
+
+	testOptions(t, "${=AVAR} $BVAR\n", []string{"value1", "value2", "value3"})
+}
+
+func TestQuoting(t *testing.T) {
+	os.Setenv("AVAR", "a value")
+	defer os.Unsetenv("AVAR")
+
+	tests := []struct {
+		line  string
+		words []string
+	}{
+		{`-DGREETING="hello world"`, []string{"-DGREETING=hello world"}},
+		{`'-I/path with spaces' -O2`, []string{"-I/path with spaces", "-O2"}},
+		{`-I/path\ with\ spaces`, []string{"-I/path with spaces"}},
+		{`"$AVAR" '$AVAR' \$AVAR`, []string{"a value", "$AVAR", "$AVAR"}},
+		{`"say \"hi\"" 'it''s'`, []string{`say "hi"`, "its"}},
+		{`/IC:\include\dir`, []string{`/IC:\include\dir`}},
+		{`-D'X=$'"$AVAR"`, []string{"-DX=$a value"}},
+		{`-DX=${=AVAR}!`, []string{"-DX=a", "value!"}},
+	}
+	for _, test := range tests {
+		testOptions(t, test.line+"\n", test.words)
+	}
+
+	for _, line := range []string{`"unterminated`, `'unterminated`, `${AVAR`} {
+		if _, err := readOptionsFromString(line + "\n"); err == nil {
+			t.Errorf("%q: no error", line)
+		}
+	}
 }
 
 func TestConditionals(t *testing.T) {
@@ -239,6 +270,31 @@ func TestInclude(t *testing.T) {
 	expectValues(t, options, []string{includedValue})
 }
 
+func TestIncludeOlderFile(t *testing.T) {
+	setupTest(t)
+	defer removeTestDirs(t)
+
+	filename := filepath.Join(testProjectChildDir, testFilename)
+	includedFilename := filepath.Join(testProjectChildDir, "included.options")
+	makeFileWithContent(t, filename, "!include included.options\n")
+	makeFileWithContent(t, includedFilename, "included-value\n")
+
+	// The options are as new as the newest file read.
+	//
+	modtime := time.Now().Truncate(time.Second)
+	if err := os.Chtimes(filename, modtime, modtime); err != nil {
+		t.Fatal(err)
+	}
+	older := modtime.Add(-time.Hour)
+	if err := os.Chtimes(includedFilename, older, older); err != nil {
+		t.Fatal(err)
+	}
+	options := mustReadOptionsFromFile(t, filename)
+	if !options.ModTime().Equal(modtime) {
+		t.Fatalf("options modtime %v, expected %v", options.ModTime(), modtime)
+	}
+}
+
 func TestIncludeNonExistentFile(t *testing.T) {
 	setupTest(t)
 	defer removeTestDirs(t)
@@ -258,6 +314,83 @@ func TestIncludeNonExistentFile(t *testing.T) {
 	}
 }
 
+func TestIncludeCycle(t *testing.T) {
+	setupTest(t)
+	defer removeTestDirs(t)
+
+	filename := filepath.Join(testProjectChildDir, testFilename)
+	makeFileWithContent(t, filename, "!include a.options\n")
+	makeFileWithContent(t, filepath.Join(testProjectChildDir, "a.options"), "!include b.options\n")
+	makeFileWithContent(t, filepath.Join(testProjectChildDir, "b.options"), "-b\n!include a.options\n")
+	_, err := readOptionsFromFile(t, filename)
+	if err == nil || !strings.Contains(err.Error(), "include cycle: ") || !strings.HasSuffix(err.Error(), filepath.Join(testProjectChildDir, "a.options")) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestIncludeOnceAndOptional(t *testing.T) {
+	setupTest(t)
+	defer removeTestDirs(t)
+
+	filename := filepath.Join(testProjectChildDir, testFilename)
+	makeFileWithContent(t, filename, `!include-once common.options
+!include "common.options"
+!include-once common.options
+!include-optional missing.options
+-main
+`)
+	makeFileWithContent(t, filepath.Join(testProjectChildDir, "common.options"), "-common\n")
+	options := mustReadOptionsFromFile(t, filename)
+	expectValues(t, options, []string{"-common", "-common", "-main"})
+}
+
+func TestIncludeGlob(t *testing.T) {
+	setupTest(t)
+	defer removeTestDirs(t)
+
+	flagsDir := filepath.Join(testProjectChildDir, "flags.d")
+	if err := os.MkdirAll(flagsDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	makeFileWithContent(t, filepath.Join(flagsDir, "20-b.opt"), "-b\n")
+	makeFileWithContent(t, filepath.Join(flagsDir, "10-a.opt"), "-a\n")
+	filename := filepath.Join(testProjectChildDir, testFilename)
+	makeFileWithContent(t, filename, "!include flags.d/*.opt\n!include none.d/*.opt\n")
+	options := mustReadOptionsFromFile(t, filename)
+	expectValues(t, options, []string{"-a", "-b"})
+}
+
+func TestIncludePath(t *testing.T) {
+	setupTest(t)
+	defer removeTestDirs(t)
+
+	saved := IncludePath
+	defer func() { IncludePath = saved }()
+	IncludePath = []string{testProjectRootDir}
+
+	makeFileWithContent(t, filepath.Join(testProjectRootDir, "shared.options"), "-shared\n")
+	makeFileWithContent(t, filepath.Join(testProjectChildDir, "shared.options"), "-local\n")
+	filename := filepath.Join(testProjectChildDir, testFilename)
+	makeFileWithContent(t, filename, "!include shared.options\n!include <shared.options>\n")
+	options := mustReadOptionsFromFile(t, filename)
+	expectValues(t, options, []string{"-local", "-shared"})
+}
+
+func TestIncludeAngleBracketsWithoutIncludePath(t *testing.T) {
+	setupTest(t)
+	defer removeTestDirs(t)
+
+	saved := IncludePath
+	defer func() { IncludePath = saved }()
+	IncludePath = nil
+
+	makeFileWithContent(t, filepath.Join(testProjectChildDir, "shared.options"), "-local\n")
+	filename := filepath.Join(testProjectChildDir, testFilename)
+	makeFileWithContent(t, filename, "!include <shared.options>\n")
+	options := mustReadOptionsFromFile(t, filename)
+	expectValues(t, options, []string{"-local"})
+}
+
 func TestInherit(t *testing.T) {
 	setupTest(t)
 	defer removeTestDirs(t)
@@ -346,3 +479,203 @@ func TestInheritPlatformSpecificFile(t *testing.T) {
 	options := mustReadOptionsFromFile(t, fileInChildDir)
 	expectValues(t, options, []string{directValue, inheritedValue})
 }
+
+func TestNestedInSkippedSection(t *testing.T) {
+	data := `
+!ifdef NOTDEF
+  !ifdef NOTDEF
+    a-value
+  !else
+    b-value
+  !endif
+  c-value
+!else
+  d-value
+!endif
+`
+	testOptions(t, data, []string{"d-value"})
+}
+
+func TestIfExpressions(t *testing.T) {
+	os.Setenv("DCC_TEST_CC", "gcc")
+	os.Setenv("DCC_TEST_VERSION", "4.10.1")
+	defer os.Unsetenv("DCC_TEST_CC")
+	defer os.Unsetenv("DCC_TEST_VERSION")
+
+	tests := []struct {
+		expr   string
+		result bool
+	}{
+		{`$DCC_TEST_CC == gcc`, true},
+		{`"$DCC_TEST_CC" != "gcc"`, false},
+		{`${DCC_TEST_VERSION} >= 4.9`, true},
+		{`$DCC_TEST_VERSION < 4.10`, false},
+		{`defined(DCC_TEST_CC) && !defined(NOTDEF)`, true},
+		{`defined(NOTDEF) || $DCC_TEST_CC == clang`, false},
+		{`!($DCC_TEST_CC == clang || $DCC_TEST_CC == gcc)`, false},
+		{`$NOTDEF`, false},
+		{`1`, true},
+		{`${NOTDEF:-${DCC_TEST_CC}} == gcc`, true},
+		{`"${NOTDEF:-${NOTDEF2:-clang}}" == clang`, true},
+		{`${DCC_TEST_CC:-${NOTDEF}} == clang`, false},
+		{`!$DCC_TEST_CC == clang`, false},
+		{`!defined(NOTDEF) == 1`, true},
+		{`!defined(DCC_TEST_CC) == 0`, true},
+	}
+	for _, test := range tests {
+		data := fmt.Sprintf("!if %s\nyes\n!else\nno\n!endif\n", test.expr)
+		expected := []string{"no"}
+		if test.result {
+			expected = []string{"yes"}
+		}
+		options := mustReadOptionsFromString(t, data)
+		if len(options.Values) != 1 || options.Values[0] != expected[0] {
+			t.Errorf("!if %s: got %q, expected %q", test.expr, options.Values, expected)
+		}
+	}
+}
+
+func TestElif(t *testing.T) {
+	data := `
+!if a == b
+  a-value
+!elif a == a
+  b-value
+!elif b == b
+  c-value
+!else
+  d-value
+!endif
+`
+	testOptions(t, data, []string{"b-value"})
+}
+
+func TestConditionalErrors(t *testing.T) {
+	tests := []struct {
+		data    string
+		message string
+	}{
+		{"a\n!endif\n", "<data>:2 not within a conditional section"},
+		{"!ifdef PATH\n!else\n!else\n!endif\n", "<data>:3 !else after !else"},
+		{"!ifdef PATH\n!else\n!elif 1\n!endif\n", "<data>:3 !elif after !else"},
+		{"a\n!ifdef PATH\nb\n", "<data>:2 conditional section has no !endif"},
+		{"!if (a == b\n!endif\n", "<data>:1 !if: missing ) in expression"},
+	}
+	for _, test := range tests {
+		_, err := readOptionsFromString(test.data)
+		if err == nil || !strings.HasSuffix(err.Error(), test.message) {
+			t.Errorf("%q: got error %v, expected %q", test.data, err, test.message)
+		}
+	}
+}
+
+func TestIfCompiler(t *testing.T) {
+	defer func(family string) { CompilerFamily = family }(CompilerFamily)
+	data := `
+!ifcompiler clang
+  a-value
+!elif 1
+  !ifcompiler msvc gcc
+    b-value
+  !endif
+!endif
+`
+	CompilerFamily = ClangFamily
+	testOptions(t, data, []string{"a-value"})
+	CompilerFamily = GccFamily
+	testOptions(t, data, []string{"b-value"})
+	CompilerFamily = IntelFamily
+	testOptions(t, data, []string{})
+}
+
+func TestBuiltinVariables(t *testing.T) {
+	setupTest(t)
+	defer removeTestDirs(t)
+	SetBuiltin(BuiltinMode, "lib")
+	os.Setenv(BuiltinArch, "not-the-arch")
+	defer os.Unsetenv(BuiltinArch)
+
+	filename := filepath.Join(testProjectChildDir, testFilename)
+	makeFileWithContent(t, filename, `
+-I$DCC_ROOT/include
+!if $DCC_OS == `+runtime.GOOS+` && $DCC_MODE == lib
+-D${DCC_ARCH}
+!endif
+`)
+	root, err := filepath.Abs(testProjectChildDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := mustReadOptionsFromFile(t, filename)
+	expected := []string{"-I" + root + "/include", "-D" + runtime.GOARCH}
+	if strings.Join(options.Values, " ") != strings.Join(expected, " ") {
+		t.Fatalf("got %q, expected %q", options.Values, expected)
+	}
+}
+
+func TestPrescanArgs(t *testing.T) {
+	tests := []struct {
+		args                 []string
+		mode, output, objdir string
+	}{
+		{[]string{"a.c"}, "exe", platform.DefaultExecutable, ObjsDir},
+		{[]string{"-c", "-ofoo.o", "a.c"}, "compile", "foo.o", ObjsDir},
+		{[]string{"--lib", "libx.a", "--objdir", "obj", "a.c"}, "lib", "libx.a", "obj"},
+		{[]string{"-o", "prog", "a.c"}, "exe", "prog", ObjsDir},
+	}
+	for _, test := range tests {
+		mode, output, objdir := PrescanArgs(test.args)
+		if mode != test.mode || output != test.output || objdir != test.objdir {
+			t.Errorf("%q: got %q %q %q, expected %q %q %q", test.args, mode, output, objdir, test.mode, test.output, test.objdir)
+		}
+	}
+}
+
+func TestSetVariables(t *testing.T) {
+	setupTest(t)
+	defer removeTestDirs(t)
+	defer func() { defines = make(map[string]string) }()
+
+	includedFilename := filepath.Join(testProjectChildDir, "included.options")
+	makeFileWithContent(t, includedFilename, `
+$WARN
+!set LOCAL=local-value
+`)
+	filename := filepath.Join(testProjectChildDir, testFilename)
+	makeFileWithContent(t, filename, `
+!set WARN=-Wall "-Wformat=2 " -Wextra
+!set-default OPT=-O2
+!set-default WARN=ignored
+!include included.options
+$OPT ${LOCAL:-no-local} ${DCC_TEST_UNDEFINED:-$OPT}
+`)
+
+	expect := func(expected ...string) {
+		options := mustReadOptionsFromFile(t, filename)
+		if strings.Join(options.Values, " ") != strings.Join(expected, " ") {
+			t.Fatalf("got %q, expected %q", options.Values, expected)
+		}
+	}
+
+	expect("-Wall", "-Wformat=2 ", "-Wextra", "-O2", "no-local", "-O2")
+
+	os.Setenv("OPT", "-Os")
+	defer os.Unsetenv("OPT")
+	expect("-Wall", "-Wformat=2 ", "-Wextra", "-Os", "no-local", "-Os")
+
+	if err := Define("OPT=-O0"); err != nil {
+		t.Fatal(err)
+	}
+	expect("-Wall", "-Wformat=2 ", "-Wextra", "-O0", "no-local", "-O0")
+}
+
+func TestRequiredVariable(t *testing.T) {
+	_, err := readOptionsFromString("\n${DCC_TEST_UNDEFINED:?required}\n")
+	if err == nil || !strings.HasSuffix(err.Error(), "<data>:2 DCC_TEST_UNDEFINED: required") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	_, err = readOptionsFromString("!set 1X=y\n")
+	if err == nil || !strings.HasSuffix(err.Error(), `<data>:1 !set: "1X" is not a valid variable name`) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
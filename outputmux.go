@@ -9,127 +9,127 @@
 package main
 
 import (
-	"bufio"
-	"fmt"
+	"bytes"
 	"io"
-	"log"
-	"os"
+	"io/ioutil"
+	"regexp"
+	"sync"
 )
 
 // OutputMux is an io.Writer multiplexor that is used to ensure output
 // written to multiple Writers is NOT interleaved when written to the
 // final output writer.
 //
-// The OutputMux NewWriter method returns an io.WriteCloser that lets
-// it user to write via the OutputMux. Data written to that
-// WriteCloser is held in memory until its Close method is called at
-// which time the buffered data is flushed to the OutputMux's output
-// io.Writer. There is no limit to the amount of data held in an
-// output mux io.Writer(Closer) but in this application that should
+// The OutputMux NewWriter method returns a JobOutput, an
+// io.WriteCloser, that lets its user write via the OutputMux. Data
+// written to a JobOutput is held in memory until its Close method is
+// called at which time the buffered data is written, in one go, to
+// the OutputMux's output io.Writer. There is no limit to the amount
+// of data held in a JobOutput but in this application that should
 // not be an issue although C++ template errors can produce quite
 // larges amounts of output.
 //
+// A compilation job uses the same JobOutput for the compiler's
+// standard output and standard error so the two are captured
+// together, in the order they were written. The JobOutput may also
+// save its output to a log file so it can be inspected after the
+// fact.
+//
+// An OutputMux may also de-duplicate diagnostics (see dedup.go) so a
+// warning in a header file included by many sources is output once.
+//
 type OutputMux struct {
-	w    io.Writer         // output
-	mux  chan outputMuxMsg // input
-	stop chan struct{}     // stop
+	mutex sync.Mutex
+	w     io.Writer
+	dedup *DiagnosticDeduper
 }
 
-// The io.Writer that talks to an OutputMux is the write-side of an
-// os.Pipe.  the read-side of the pipe is read by a separate goroutine
-// that transfers lines of text read from the pipe to the central
-// multiplexor. Lines are transferred as outputMuxMsg structures.
-//
-type outputMuxMsg struct {
-	source io.Reader
-	text   string
-	eof    bool
+// JobOutput is the io.WriteCloser used to write a single job's
+// output via an OutputMux.
+//
+type JobOutput struct {
+	mux     *OutputMux
+	mutex   sync.Mutex
+	buf     bytes.Buffer
+	logfile string
 }
 
 // NewOutputMux returns a new OutputMux that will write
 // its output to the given io.Writer.
 //
 func NewOutputMux(w io.Writer) *OutputMux {
-	mux := &OutputMux{
-		w:    w,
-		mux:  make(chan outputMuxMsg, 1000),
-		stop: make(chan struct{}),
-	}
-	go mux.run()
-	return mux
+	return &OutputMux{w: w}
 }
 
-// The run method runs the receiver's input processing loop, reading
-// and buffering output generated by its io.WriteCloser clients and
-// flushing that output when the client closes. If the receiver is
-// stopped all buffered output is flushed before run() returns.
-//
-func (om *OutputMux) run() {
-	// Each Reader goroutine, and its corresponding Writer, has a
-	// slice of strings acting as an output buffer. We don't
-	// expect too much output although errors from C++ template
-	// errors can be quite long.
-	//
-	buffers := make(map[io.Reader][]string)
+// EnableDedup has the receiver remove diagnostics that have already
+// been output from the output of its JobOutputs.
+//
+func (om *OutputMux) EnableDedup() {
+	om.dedup = NewDiagnosticDeduper()
+}
 
-	flush := func(r io.Reader) {
-		if slice, found := buffers[r]; found {
-			for _, line := range slice {
-				fmt.Fprintln(om.w, line)
-			}
-			buffers[r] = nil
-		}
-	}
+// NewWriter returns a JobOutput used to send data to the receiver
+// for eventual output. If logfile is not empty the JobOutput's
+// output is also written to that file when it is closed.
+//
+func (om *OutputMux) NewWriter(logfile string) *JobOutput {
+	return &JobOutput{mux: om, logfile: logfile}
+}
+
+// Write writes data to the receiver's buffer.
+//
+func (j *JobOutput) Write(p []byte) (int, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.buf.Write(p)
+}
 
-	for {
-		select {
-		case <-om.stop:
-			for b := range buffers {
-				flush(b)
-			}
-			om.stop <- struct{}{}
-			return
+// Bytes returns the output written to the receiver.
+//
+func (j *JobOutput) Bytes() []byte {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.buf.Bytes()
+}
 
-		case msg := <-om.mux:
-			if msg.text != "" {
-				if _, ok := buffers[msg.source]; !ok {
-					buffers[msg.source] = make([]string, 0, 30)
-				}
-				buffers[msg.source] = append(buffers[msg.source], msg.text)
-			}
-			if msg.eof {
-				flush(msg.source)
-			}
+// Close flushes the receiver's output to its OutputMux and writes
+// its log file, if it has one. Any terminal escape sequences, used to
+// colorize the output, are removed from the log file's content.
+//
+func (j *JobOutput) Close() error {
+	output := j.Bytes()
+	filtered := output
+	if j.mux.dedup != nil {
+		filtered = j.mux.dedup.Filter(output)
+	}
+	j.mux.mutex.Lock()
+	_, err := j.mux.w.Write(filtered)
+	j.mux.mutex.Unlock()
+	if j.logfile != "" {
+		if err2 := ioutil.WriteFile(j.logfile, StripEscapes(output), 0666); err == nil {
+			err = err2
 		}
 	}
+	return err
 }
 
-// NewWriter returns an io.Writer used to send data to the receiver
-// for eventual output.
+// Close closes the receiver. JobOutputs write their output as they
+// are closed so all that remains is to report any diagnostics that
+// were de-duplicated.
 //
-func (om *OutputMux) NewWriter() *os.File {
-	r, w, err := os.Pipe()
-	if err != nil {
-		log.Panic(err)
+func (om *OutputMux) Close() {
+	if om.dedup != nil {
+		om.mutex.Lock()
+		om.dedup.Report(om.w)
+		om.mutex.Unlock()
 	}
-	go func(r io.Reader) {
-		in := bufio.NewScanner(r)
-		for in.Scan() {
-			om.mux <- outputMuxMsg{r, in.Text(), false}
-		}
-		om.mux <- outputMuxMsg{r, "", true}
-	}(r)
-	return w
 }
 
-// Close closes the receiver, stopping any processing of clients and
-// flushing any buffered output.
-//
-// Close sends a stop signal to the cause the receiver's run method to
-// stop processing and awaits the, ignored, response indicating
-// processing has stopped.
+var escapeSequence = regexp.MustCompile("\x1b\\[[0-9;]*[A-Za-z]")
+
+// StripEscapes removes ANSI terminal escape sequences, as used by
+// compilers to colorize diagnostics, from some text.
 //
-func (om *OutputMux) Close() {
-	om.stop <- struct{}{}
-	<-om.stop
+func StripEscapes(text []byte) []byte {
+	return escapeSequence.ReplaceAll(text, nil)
 }
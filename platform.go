@@ -20,6 +20,7 @@ import (
 type Platform struct {
 	DefaultCC         string
 	DefaultCXX        string
+	DefaultFamily     string // compiler family of the default compilers
 	ObjectFileSuffix  string
 	StaticLibPrefix   string
 	StaticLibSuffix   string
@@ -9,14 +9,13 @@
 package main
 
 import (
-	"fmt"
-	"os"
 	"strings"
 )
 
 var platform = Platform{
 	DefaultCC:         "cc",
 	DefaultCXX:        "c++",
+	DefaultFamily:     ClangFamily,
 	ObjectFileSuffix:  ".o",
 	StaticLibPrefix:   "lib",
 	StaticLibSuffix:   ".a",
@@ -32,14 +31,7 @@ var platform = Platform{
 	IsRoot:		   UnixIsRoot,
 }
 
-func logCommand(cmd string, args []string) {
-	if Quiet {
-		return
-	}
-	if Verbose {
-		fmt.Fprintln(os.Stdout, cmd, strings.Join(args, " "))
-		return
-	}
+func runCommand(kind, cmd string, args []string) error {
 	filename := ""
 	nargs := len(args)
 	for index, arg := range args {
@@ -50,7 +42,13 @@ func logCommand(cmd string, args []string) {
 			}
 		}
 	}
-	fmt.Fprintln(os.Stdout, cmd, filename)
+	if Quiet {
+		return RunAction(kind, filename, "", cmd, args)
+	}
+	if Verbose {
+		return RunAction(kind, filename, cmd+" "+strings.Join(args, " "), cmd, args)
+	}
+	return RunAction(kind, filename, cmd+" "+filename, cmd, args)
 }
 
 // MacosCreateLibrary creates a static library using libtool.
@@ -59,8 +57,7 @@ func MacosCreateLibrary(filename string, objectFiles []string) error {
 	const libtool = "libtool"
 	args := []string{"-static", "-o", filename}
 	args = append(args, objectFiles...)
-	logCommand(libtool, args)
-	return Exec(libtool, args, os.Stderr)
+	return runCommand(ActionLib, libtool, args)
 }
 
 // MacosCreateDLL creates a dynamic library using the underlying
@@ -72,8 +69,7 @@ func MacosCreateDLL(filename string, objectFiles []string, libraryFiles []string
 	args = append(args, objectFiles...)
 	args = append(args, libraryFiles...)
 	args = append(args, frameworks...)
-	logCommand(ActualCompiler.Name(), args)
-	return Exec(ActualCompiler.Name(), args, os.Stderr)
+	return runCommand(ActionDll, ActualCompiler.Name(), args)
 }
 
 // MacosCreatePlugin creates a bundle
@@ -84,6 +80,5 @@ func MacosCreatePlugin(filename string, objectFiles []string, libraryFiles []str
 	args = append(args, objectFiles...)
 	args = append(args, libraryFiles...)
 	args = append(args, frameworks...)
-	logCommand(ActualCompiler.Name(), args)
-	return Exec(ActualCompiler.Name(), args, os.Stderr)
+	return runCommand(ActionPlugin, ActualCompiler.Name(), args)
 }
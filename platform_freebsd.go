@@ -11,6 +11,7 @@ package main
 var platform = Platform{
 	DefaultCC:         "cc",
 	DefaultCXX:        "c++",
+	DefaultFamily:     ClangFamily,
 	ObjectFileSuffix:  ".o",
 	DynamicLibPrefix:  "lib",
 	DynamicLibSuffix:  ".so",
@@ -55,6 +55,7 @@ func linuxSelectTarget(p *Platform, target string) error {
 var platform = Platform{
 	DefaultCC:         "cc",
 	DefaultCXX:        "c++",
+	DefaultFamily:     GccFamily,
 	ObjectFileSuffix:  ".o",
 	DynamicLibPrefix:  "lib",
 	DynamicLibSuffix:  ".so",
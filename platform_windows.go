@@ -9,7 +9,6 @@
 package main
 
 import (
-	"os"
 	"path/filepath"
 	"strings"
 )
@@ -17,6 +16,7 @@ import (
 var platform = Platform{
 	DefaultCC:         "cl",
 	DefaultCXX:        "cl",
+	DefaultFamily:     MsvcFamily,
 	ObjectFileSuffix:  ".obj",
 	StaticLibSuffix:   ".lib",
 	DynamicLibSuffix:  ".dll",
@@ -32,7 +32,13 @@ var platform = Platform{
 // using Microsoft's LIB.EXE
 func WindowsCreateLibrary(filename string, objectFiles []string) error {
 	args := append([]string{"/nologo", "/out:" + filename}, objectFiles...)
-	return Exec("lib", args, os.Stderr)
+	displayed := ""
+	if Verbose {
+		displayed = "lib " + strings.Join(args, " ")
+	} else if !Quiet {
+		displayed = "lib " + filename
+	}
+	return RunAction(ActionLib, filename, displayed, "lib", args)
 }
 
 // WindowsCreateDLL creates a dynamic library from the supplied object files
@@ -41,7 +47,13 @@ func WindowsCreateDLL(filename string, objectFiles []string, libraryFiles []stri
 	args := append([]string{"/nologo", "/DLL", "/OUT:" + filename}, objectFiles...)
 	args = append(args, linkerOptions...)
 	args = append(args, libraryFiles...)
-	return Exec("link", args, os.Stderr)
+	displayed := ""
+	if Verbose {
+		displayed = "link " + strings.Join(args, " ")
+	} else if !Quiet {
+		displayed = "link " + filename
+	}
+	return RunAction(ActionDll, filename, displayed, "link", args)
 }
 
 // WindowsIsRoot determines if a pathname represents a "root"
@@ -0,0 +1,305 @@
+// dcc - dependency-driven C/C++ compiler front end
+//
+// Copyright © A.Newman 2015.
+//
+// This source code is released under version 2 of the  GNU Public License.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Build reports.
+//
+// Everything dcc does, or decides not to do, is recorded as an Action
+// in the BuildReport. Compiling a source file is an action, as is
+// linking a program or creating a library. A source file that is up
+// to date is recorded as a skipped action. When the build ends the
+// BuildReport is used to output a summary of the build.
+//
+
+// Kinds of Action.
+//
+const (
+	ActionScan    = "scan"
+	ActionCompile = "compile"
+	ActionLink    = "link"
+	ActionLib     = "lib"
+	ActionDll     = "dll"
+	ActionPlugin  = "plugin"
+)
+
+// Action records a single action performed by a build.
+//
+type Action struct {
+	Kind    string    // ActionCompile, ActionLink, etc...
+	Source  string    // the source file compiled, if any
+	Target  string    // the file created
+	Worker  int       // the index of the worker performing the action, -1 if none
+	Start   time.Time // when the action started
+	End     time.Time // when the action finished
+	Skipped bool      // true if the action was not needed
+	Reason  string    // why the action was skipped
+	Err     error     // the action's error, nil if it succeeded
+	Output  []byte    // the output of the action, if captured
+}
+
+// Description returns a short description of the receiver.
+//
+func (a *Action) Description() string {
+	switch a.Kind {
+	case ActionScan:
+		return "scan " + a.Source
+	case ActionCompile:
+		return "cc " + a.Source
+	case ActionLib:
+		return "ar " + a.Target
+	default:
+		return "ld " + a.Target
+	}
+}
+
+// ExitStatus returns the exit status of the command that performed
+// the receiver, 0 if it succeeded or -1 if unknown.
+//
+func (a *Action) ExitStatus() int {
+	if a.Err == nil {
+		return 0
+	}
+	if err, ok := a.Err.(*exec.ExitError); ok {
+		return err.ExitCode()
+	}
+	return -1
+}
+
+// Duration returns the time taken by the receiver.
+//
+func (a *Action) Duration() time.Duration {
+	return a.End.Sub(a.Start)
+}
+
+// FirstError returns the first error line in the receiver's output,
+// or the receiver's error if there is no output.
+//
+func (a *Action) FirstError() string {
+	var first string
+	input := bufio.NewScanner(bytes.NewReader(StripEscapes(a.Output)))
+	for input.Scan() {
+		line := strings.TrimSpace(input.Text())
+		if d, ok := ParseDiagnostic(line); ok && d.IsError() {
+			return line
+		}
+		if first == "" && line != "" {
+			first = line
+		}
+	}
+	if first == "" && a.Err != nil {
+		first = a.Err.Error()
+	}
+	return first
+}
+
+// BuildObserver is notified of actions as they happen.
+//
+type BuildObserver interface {
+	ActionScheduled(a *Action) // the action will be performed
+	ActionStarted(a *Action)   // the action has started
+	ActionFinished(a *Action)  // the action has finished, or was skipped
+}
+
+// BuildReport records the actions of a build. A BuildReport may be
+// used concurrently.
+//
+type BuildReport struct {
+	mutex      sync.Mutex
+	start      time.Time
+	cpu        time.Duration
+	actions    []*Action
+	observers  []BuildObserver
+	linkKind   string // kind of the final link step, if any
+	linkTarget string // the target of the final link step
+}
+
+// NewBuildReport returns a new BuildReport for a build starting now.
+//
+func NewBuildReport() *BuildReport {
+	return &BuildReport{start: time.Now()}
+}
+
+// AddObserver adds a BuildObserver to be notified of actions.
+//
+func (r *BuildReport) AddObserver(o BuildObserver) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.observers = append(r.observers, o)
+}
+
+// Schedule notes that an action will be performed.
+//
+func (r *BuildReport) Schedule(a *Action) {
+	for _, o := range r.getObservers() {
+		o.ActionScheduled(a)
+	}
+}
+
+// Begin notes that an action is starting.
+//
+func (r *BuildReport) Begin(a *Action) {
+	a.Start = time.Now()
+	for _, o := range r.getObservers() {
+		o.ActionStarted(a)
+	}
+}
+
+// Record records a finished, or skipped, action in the receiver.
+//
+func (r *BuildReport) Record(a *Action) {
+	r.mutex.Lock()
+	r.actions = append(r.actions, a)
+	r.mutex.Unlock()
+	for _, o := range r.getObservers() {
+		o.ActionFinished(a)
+	}
+}
+
+func (r *BuildReport) getObservers() []BuildObserver {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.observers
+}
+
+// AddCPUTime adds the CPU time used by a command to the receiver's
+// total.
+//
+func (r *BuildReport) AddCPUTime(d time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.cpu += d
+}
+
+// SetLinkStep tells the receiver the build ends with a link step,
+// i.e. linking an executable or creating a library.
+//
+func (r *BuildReport) SetLinkStep(kind, target string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.linkKind, r.linkTarget = kind, target
+}
+
+// StartTime returns the time the receiver's build started.
+//
+func (r *BuildReport) StartTime() time.Time {
+	return r.start
+}
+
+// LinkStep returns the kind and target of the build's link step, if
+// it has one.
+//
+func (r *BuildReport) LinkStep() (kind, target string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.linkKind, r.linkTarget
+}
+
+// SkipLinkStep records the build's link step, if it has one, as
+// skipped for the given reason unless it has already been recorded.
+//
+func (r *BuildReport) SkipLinkStep(reason string) {
+	kind, target := r.LinkStep()
+	if kind == "" {
+		return
+	}
+	for _, a := range r.Actions() {
+		if a.Kind != ActionScan && a.Kind != ActionCompile {
+			return
+		}
+	}
+	r.Record(&Action{Kind: kind, Target: target, Worker: -1, Skipped: true, Reason: reason})
+}
+
+// Actions returns the actions recorded in the receiver.
+//
+func (r *BuildReport) Actions() []*Action {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]*Action(nil), r.actions...)
+}
+
+// Summarize writes a summary of the build to the given io.Writer.
+//
+func (r *BuildReport) Summarize(w io.Writer, sources int) {
+	actions := r.Actions()
+	linkKind, linkTarget := r.LinkStep()
+	r.mutex.Lock()
+	cpu := r.cpu
+	r.mutex.Unlock()
+
+	var compiled, skipped int
+	var failed []*Action
+	var link *Action
+	for _, a := range actions {
+		switch {
+		case a.Kind == ActionScan:
+			continue
+		case a.Kind != ActionCompile:
+			link = a
+		case a.Skipped && a.Reason == TooManyErrors:
+			continue // counted as not compiled
+		case a.Skipped:
+			skipped++
+		case a.Err != nil:
+			failed = append(failed, a)
+		default:
+			compiled++
+		}
+	}
+
+	fmt.Fprintf(w, "%d compiled, %d up to date, %d failed", compiled, skipped, len(failed))
+	if notRun := sources - compiled - skipped - len(failed); notRun > 0 {
+		fmt.Fprintf(w, ", %d not compiled", notRun)
+	}
+	wall := time.Since(r.start).Round(time.Millisecond)
+	fmt.Fprintf(w, " in %s (%s CPU)\n", wall, cpu.Round(time.Millisecond))
+
+	if linkKind != "" {
+		status := "up to date"
+		switch {
+		case link != nil && link.Skipped:
+			status = link.Reason
+		case link != nil && link.Err != nil:
+			status = "failed"
+		case link != nil:
+			status = fmt.Sprintf("done in %s", link.Duration().Round(time.Millisecond))
+		case len(failed) > 0 || compiled+skipped < sources:
+			status = "not done"
+		}
+		fmt.Fprintf(w, "%s %s: %s\n", linkKind, linkTarget, status)
+	}
+
+	for _, a := range failed {
+		fmt.Fprintf(w, "FAILED %s: %s\n", a.Source, a.FirstError())
+	}
+}
+
+// writeSummary outputs the build summary if the build involved more
+// than one source file or failed. Single file compiles, e.g. make
+// running dcc -c for each file, have nothing to summarize. The
+// summary is always output when asked for and otherwise not output
+// when we're being quiet.
+//
+func writeSummary(sources int, failed bool) {
+	if ShowSummary || (!Quiet && (sources > 1 || failed)) {
+		Report.Summarize(Status.Writer(os.Stderr), sources)
+	}
+}
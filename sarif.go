@@ -0,0 +1,196 @@
+// dcc - dependency-driven C/C++ compiler front end
+//
+// Copyright © A.Newman 2015.
+//
+// This source code is released under version 2 of the  GNU Public License.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// SARIF, the Static Analysis Results Interchange Format, is an OASIS
+// standard format for the output of static analysis tools and is
+// understood by many code review tools. We output a minimal SARIF
+// 2.1.0 log with a single run containing the compiler's diagnostics.
+//
+// Warnings and errors become results. Any notes that follow a
+// diagnostic become the result's related locations. File names are
+// made relative to dcc's working directory, the source root, where
+// possible.
+//
+
+const (
+	sarifVersion = "2.1.0"
+	sarifSchema  = "https://json.schemastore.org/sarif-2.1.0.json"
+	sarifSrcRoot = "%SRCROOT%"
+)
+
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool               sarifTool                   `json:"tool"`
+	OriginalURIBaseIDs map[string]sarifArtifactLoc `json:"originalUriBaseIds,omitempty"`
+	Results            []sarifResult               `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name    string      `json:"name"`
+	Version string      `json:"version,omitempty"`
+	Rules   []sarifRule `json:"rules,omitempty"`
+}
+
+type sarifRule struct {
+	ID string `json:"id"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID           string          `json:"ruleId,omitempty"`
+	Level            string          `json:"level"`
+	Message          sarifMessage    `json:"message"`
+	Locations        []sarifLocation `json:"locations,omitempty"`
+	RelatedLocations []sarifLocation `json:"relatedLocations,omitempty"`
+}
+
+type sarifLocation struct {
+	ID               *int                  `json:"id,omitempty"`
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+	Message          *sarifMessage         `json:"message,omitempty"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLoc `json:"artifactLocation"`
+	Region           *sarifRegion     `json:"region,omitempty"`
+}
+
+type sarifArtifactLoc struct {
+	URI       string `json:"uri"`
+	URIBaseID string `json:"uriBaseId,omitempty"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn,omitempty"`
+}
+
+// sarifLevel maps a compiler's diagnostic severity to a SARIF level.
+//
+func sarifLevel(severity string) string {
+	switch severity {
+	case "error", "fatal error":
+		return "error"
+	case "warning":
+		return "warning"
+	default:
+		return "note"
+	}
+}
+
+// sarifArtifact returns the SARIF artifact location of a file,
+// relative to the source root if the file is within it.
+//
+func sarifArtifact(file string) sarifArtifactLoc {
+	path := absPath(file)
+	if rel, err := filepath.Rel(DccCurrentDirectory, path); err == nil && !strings.HasPrefix(rel, "..") {
+		return sarifArtifactLoc{URI: filepath.ToSlash(rel), URIBaseID: sarifSrcRoot}
+	}
+	return sarifArtifactLoc{URI: fileURI(path)}
+}
+
+// fileURI returns the file: URI for an absolute path.
+//
+func fileURI(path string) string {
+	path = filepath.ToSlash(path)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path // windows, C:/...
+	}
+	return (&url.URL{Scheme: "file", Path: path}).String()
+}
+
+// sarifLocationOf returns the SARIF location of a diagnostic.
+//
+func sarifLocationOf(d *Diagnostic) sarifLocation {
+	loc := sarifLocation{
+		PhysicalLocation: sarifPhysicalLocation{
+			ArtifactLocation: sarifArtifact(d.File),
+		},
+	}
+	if d.Line > 0 {
+		loc.PhysicalLocation.Region = &sarifRegion{StartLine: d.Line, StartColumn: d.Column}
+	}
+	return loc
+}
+
+// NewSARIFLog returns a SARIF log containing the given diagnostics.
+//
+func NewSARIFLog(diagnostics []Diagnostic) *sarifLog {
+	run := sarifRun{
+		Tool: sarifTool{
+			Driver: sarifDriver{
+				Name:    "dcc",
+				Version: strings.TrimSpace(versionNumber),
+			},
+		},
+		OriginalURIBaseIDs: map[string]sarifArtifactLoc{
+			sarifSrcRoot: {URI: fileURI(DccCurrentDirectory) + "/"},
+		},
+		Results: []sarifResult{},
+	}
+	rules := make(StringSet)
+	for i := range diagnostics {
+		d := &diagnostics[i]
+		if d.IsNote() && len(run.Results) > 0 {
+			result := &run.Results[len(run.Results)-1]
+			id := len(result.RelatedLocations) + 1
+			loc := sarifLocationOf(d)
+			loc.ID = &id
+			loc.Message = &sarifMessage{Text: d.Message}
+			result.RelatedLocations = append(result.RelatedLocations, loc)
+			continue
+		}
+		if d.Check != "" && !rules.Contains(d.Check) {
+			rules.Insert(d.Check)
+			run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, sarifRule{ID: d.Check})
+		}
+		run.Results = append(run.Results, sarifResult{
+			RuleID:    d.Check,
+			Level:     sarifLevel(d.Severity),
+			Message:   sarifMessage{Text: d.Message},
+			Locations: []sarifLocation{sarifLocationOf(d)},
+		})
+	}
+	return &sarifLog{
+		Version: sarifVersion,
+		Schema:  sarifSchema,
+		Runs:    []sarifRun{run},
+	}
+}
+
+// WriteSARIF writes diagnostics to a SARIF file.
+//
+func WriteSARIF(path string, diagnostics []Diagnostic) error {
+	data, err := json.MarshalIndent(NewSARIFLog(diagnostics), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0666)
+}
@@ -16,56 +16,66 @@ import (
 var (
 	// statCache is a cache of os.Stat results.
 	//
-	statCache = make(map[string]os.FileInfo)
+	statCache = make(map[string]*statEntry)
 
 	// statCacheMutex protects statCache
 	//
 	statCacheMutex sync.Mutex
+
+	// osStat is the function used to stat files, replaceable for
+	// testing.
+	//
+	osStat = os.Stat
 )
 
+// statEntry is a statCache entry. The done channel is closed once
+// the entry's os.Stat call has completed.
+//
+type statEntry struct {
+	done chan struct{}
+	info os.FileInfo
+	err  error
+}
+
 // Stat wraps os.Stat and caches the results.
 //
+// Stat is "single flight". Concurrent callers Stat'ing the same path
+// share a single call to os.Stat - the first caller performs the
+// os.Stat and other callers wait for its result. Generated
+// dependencies often list the same header files, in the same order,
+// and when scanning sources concurrently many routines Stat the same
+// paths at about the same time.
+//
+// Only successful results are retained in the cache. Failures are
+// returned to any waiting callers and then forgotten so that a later
+// Stat of a path sees any file created in the mean time, e.g. an
+// object file created by compilation.
+//
 func Stat(path string) (os.FileInfo, error) {
-
 	statCacheMutex.Lock()
-	info, found := statCache[path]
-	statCacheMutex.Unlock()
-
+	entry, found := statCache[path]
 	if found {
-		return info, nil
+		statCacheMutex.Unlock()
+		<-entry.done
+		return entry.info, entry.err
 	}
+	entry = &statEntry{done: make(chan struct{})}
+	statCache[path] = entry
+	statCacheMutex.Unlock()
 
-	// We don't hold the mutex while calling os.Stat and this
-	// introduces a race - multiple routines Stat'ing the same
-	// path can overlap and do the same work - call os.Stat and
-	// add the resultant info to the cache. Other than doing
-	// things more than once this doesn't really matter.
-	//
-	// Given the nature of the paths being Stat'd the FileInfo
-	// will be identical. The real effect of the race will be to
-	// call os.Stat more than once for a given path, updating the
-	// cache with identical data if it succeeds with the
-	// associated locking overhead.
-	//
-	// The likelihood of this race occurring depends the ordering
-	// and timing of Stat calls which at first would appear to be
-	// essentiallly random but it should be noted that generated
-	// dependencies will often list paths in the same order and
-	// that the initial compilation jobs will all start at about
-	// the same time.
-	//
-	info, err := os.Stat(path)
-	if err != nil {
-		return nil, err
-	}
+	entry.info, entry.err = osStat(path)
+	close(entry.done)
 
-	statCacheMutex.Lock()
-	if _, found = statCache[path]; !found {
-		statCache[path] = info
+	if entry.err != nil {
+		statCacheMutex.Lock()
+		if statCache[path] == entry {
+			delete(statCache, path)
+		}
+		statCacheMutex.Unlock()
+		return nil, entry.err
 	}
-	statCacheMutex.Unlock()
 
-	return info, nil
+	return entry.info, nil
 }
 
 // ClearCachedStat removes an entry from the cache. This is required after compilation
@@ -0,0 +1,71 @@
+// dcc - dependency-driven C/C++ compiler front end
+//
+// Copyright © A.Newman 2015.
+//
+// This source code is released under version 2 of the  GNU Public License.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStatSingleFlight(t *testing.T) {
+	setupTest(t)
+	defer removeTestDirs(t)
+
+	path := filepath.Join(testProjectRootDir, "header.h")
+	makeFile(t, path)
+	ClearCachedStat(path)
+	defer ClearCachedStat(path)
+
+	// The first os.Stat waits until the other callers have had
+	// time to call Stat. They must wait for its result rather than
+	// stat the file themselves.
+	//
+	var calls int32
+	started, release := make(chan struct{}), make(chan struct{})
+	defer func() { osStat = os.Stat }()
+	osStat = func(path string) (os.FileInfo, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+			<-release
+		}
+		return os.Stat(path)
+	}
+
+	const n = 10
+	var wg sync.WaitGroup
+	infos := make([]os.FileInfo, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			info, err := Stat(path)
+			if err != nil {
+				t.Error(err)
+			}
+			infos[i] = info
+		}(i)
+	}
+	<-started
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("%d calls of os.Stat, expected 1", calls)
+	}
+	for _, info := range infos {
+		if info != infos[0] {
+			t.Fatal("callers got different results")
+		}
+	}
+}
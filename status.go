@@ -0,0 +1,227 @@
+// dcc - dependency-driven C/C++ compiler front end
+//
+// Copyright © A.Newman 2015.
+//
+// This source code is released under version 2 of the  GNU Public License.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The status line.
+//
+// dcc outputs a line for each command it runs, "cc foo.c", "ld prog".
+// When dcc's standard output is a terminal, and dcc is not being
+// verbose, these lines are instead output as a single status line
+// that is updated as commands start and finish, in the style of
+// ninja. The status line is prefixed with a summary of the build's
+// progress defined by the DCC_STATUS environment variable, like
+// ninja's NINJA_STATUS, with the following place holders,
+//
+//	%s	the number of started actions
+//	%t	the total number of actions
+//	%f	the number of finished actions
+//	%r	the number of running actions
+//	%u	the number of remaining actions
+//	%F	the number of failed actions
+//	%p	the percentage of finished actions
+//	%e	the elapsed time
+//	%%	a single %
+//
+// Output written to the terminal while the status line is displayed,
+// i.e. compiler output, must go via the StatusLine's Writer method
+// so the status line can be removed and redrawn.
+//
+
+// DefaultStatusFormat is used when DCC_STATUS is not set.
+//
+const DefaultStatusFormat = "[%f/%t %e, %F failed] "
+
+// StatusLine displays the commands being run.
+//
+type StatusLine struct {
+	mutex    sync.Mutex
+	w        *os.File
+	format   string
+	smart    bool      // update a single line
+	start    time.Time // when the build started
+	total    int       // total number of actions
+	started  int       // number of actions started
+	finished int       // number of actions finished
+	failed   int       // number of actions that failed
+	line     string    // the displayed status line, if any
+	hidden   bool      // true if the line was removed to output something else
+	last     string    // description of the most recently started action
+}
+
+// NewStatusLine returns a StatusLine that writes to the given file
+// using the given format. The StatusLine outputs plain lines until
+// enabled by EnableUpdates.
+//
+func NewStatusLine(w *os.File, format string) *StatusLine {
+	return &StatusLine{w: w, format: format, start: time.Now()}
+}
+
+// EnableUpdates has the receiver display a single, updating, line.
+// The receiver's file must be a terminal.
+//
+func (s *StatusLine) EnableUpdates() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.smart = true
+}
+
+// AddTotal adds to the total number of actions in the build.
+//
+func (s *StatusLine) AddTotal(n int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.total += n
+}
+
+// Start records the start of an action and displays its description.
+// An empty description is not displayed.
+//
+func (s *StatusLine) Start(description string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.started++
+	if s.started > s.total {
+		s.total = s.started
+	}
+	if description == "" {
+		return
+	}
+	s.last = description
+	if !s.smart {
+		fmt.Fprintln(s.w, description)
+		return
+	}
+	s.draw()
+}
+
+// Finish records the completion of an action.
+//
+func (s *StatusLine) Finish(ok bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.finished++
+	if !ok {
+		s.failed++
+	}
+	if s.smart && s.last != "" {
+		s.draw()
+	}
+}
+
+// Done ends the current status line, if one is displayed, leaving it
+// on the terminal.
+//
+func (s *StatusLine) Done() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.line != "" && !s.hidden {
+		fmt.Fprintln(s.w)
+	}
+	s.line, s.hidden, s.last = "", false, ""
+}
+
+// Writer returns an io.Writer that writes to w, removing the status
+// line before writing, and redrawing it afterwards, so the two do not
+// become mixed.
+//
+func (s *StatusLine) Writer(w io.Writer) io.Writer {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.smart {
+		return w
+	}
+	return &statusWriter{s, w}
+}
+
+type statusWriter struct {
+	s *StatusLine
+	w io.Writer
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	s := sw.s
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.line != "" && !s.hidden {
+		io.WriteString(s.w, "\r\x1b[K")
+		s.hidden = true
+	}
+	n, err := sw.w.Write(p)
+	// Only redraw the status line once whatever was written is
+	// a complete line.
+	//
+	if s.hidden && len(p) > 0 && p[len(p)-1] == '\n' {
+		s.hidden = false
+		io.WriteString(s.w, s.line)
+	}
+	return n, err
+}
+
+// draw displays the status line. The receiver's mutex must be held.
+//
+func (s *StatusLine) draw() {
+	line := s.expand() + s.last
+	if width := TerminalWidth(s.w); width > 0 && len(line) >= width {
+		line = line[:width-1]
+	}
+	s.line, s.hidden = line, false
+	io.WriteString(s.w, "\r"+line+"\x1b[K")
+}
+
+// expand returns the receiver's format with its place holders
+// replaced with their values.
+//
+func (s *StatusLine) expand() string {
+	var b strings.Builder
+	for i := 0; i < len(s.format); i++ {
+		if s.format[i] != '%' || i+1 == len(s.format) {
+			b.WriteByte(s.format[i])
+			continue
+		}
+		i++
+		switch s.format[i] {
+		case 's':
+			b.WriteString(strconv.Itoa(s.started))
+		case 't':
+			b.WriteString(strconv.Itoa(s.total))
+		case 'f':
+			b.WriteString(strconv.Itoa(s.finished))
+		case 'r':
+			b.WriteString(strconv.Itoa(s.started - s.finished))
+		case 'u':
+			b.WriteString(strconv.Itoa(s.total - s.finished))
+		case 'F':
+			b.WriteString(strconv.Itoa(s.failed))
+		case 'p':
+			percent := 100
+			if s.total > 0 {
+				percent = 100 * s.finished / s.total
+			}
+			b.WriteString(strconv.Itoa(percent) + "%")
+		case 'e':
+			b.WriteString(time.Since(s.start).Round(100 * time.Millisecond).String())
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(s.format[i])
+		}
+	}
+	return b.String()
+}
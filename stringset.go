@@ -31,6 +31,13 @@ func (s *StringSet) Insert(el string) {
 	(*s)[el] = struct{}{}
 }
 
+/*
+ * Remove an element from a StringSet
+ */
+func (s *StringSet) Remove(el string) {
+	delete(*s, el)
+}
+
 /*
  * Return true if a StringSet contains n element
  */
@@ -0,0 +1,32 @@
+// dcc - dependency-driven C/C++ compiler front end
+//
+// Copyright © A.Newman 2015.
+//
+// This source code is released under version 2 of the  GNU Public License.
+// See the file LICENSE for details.
+//
+
+//go:build darwin || freebsd
+// +build darwin freebsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// IsTerminal returns true if the given file refers to a terminal. Other
+// character devices, e.g. /dev/null, are not terminals.
+//
+func IsTerminal(file *os.File) bool {
+	var termios syscall.Termios
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		file.Fd(),
+		uintptr(syscall.TIOCGETA),
+		uintptr(unsafe.Pointer(&termios)),
+	)
+	return errno == 0
+}
@@ -0,0 +1,49 @@
+// dcc - dependency-driven C/C++ compiler front end
+//
+// Copyright © A.Newman 2015.
+//
+// This source code is released under version 2 of the  GNU Public License.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// TerminalWidth returns the width, in columns, of the terminal
+// referred to by file, or the value of the COLUMNS environment
+// variable if that can't be determined, or zero if not set.
+//
+func TerminalWidth(file *os.File) int {
+	var ws struct {
+		row, col, xpixel, ypixel uint16
+	}
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		file.Fd(),
+		uintptr(syscall.TIOCGWINSZ),
+		uintptr(unsafe.Pointer(&ws)),
+	)
+	if errno == 0 && ws.col > 0 {
+		return int(ws.col)
+	}
+	return GetenvInt("COLUMNS", 0)
+}
+
+// IsTerminal returns true if the given file refers to a terminal. Other
+// character devices, e.g. /dev/null, are not terminals.
+//
+func IsTerminal(file *os.File) bool {
+	var termios syscall.Termios
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		file.Fd(),
+		uintptr(syscall.TCGETS),
+		uintptr(unsafe.Pointer(&termios)),
+	)
+	return errno == 0
+}
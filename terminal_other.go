@@ -0,0 +1,21 @@
+// dcc - dependency-driven C/C++ compiler front end
+//
+// Copyright © A.Newman 2015.
+//
+// This source code is released under version 2 of the  GNU Public License.
+// See the file LICENSE for details.
+//
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import "os"
+
+// TerminalWidth returns the width, in columns, of the terminal. This
+// is taken from the COLUMNS environment variable, zero if not set.
+//
+func TerminalWidth(file *os.File) int {
+	return GetenvInt("COLUMNS", 0)
+}
@@ -0,0 +1,236 @@
+// dcc - dependency-driven C/C++ compiler front end
+//
+// Copyright © A.Newman 2015.
+//
+// This source code is released under version 2 of the  GNU Public License.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Toolchain describes the compiler executable and the system include
+// directories it uses.
+//
+// Most of the dependencies of any object file are system headers,
+// files in /usr/include and the compiler's own headers. These only
+// change when the toolchain changes, i.e. is upgraded, and checking
+// them for every object file is mostly wasted effort. When dcc is told
+// to skip system headers it instead uses the toolchain's modtime as a
+// dependency of every object file. Changing the toolchain still causes
+// a rebuild.
+//
+// The toolchain's modtime is the newest of the compiler executable's
+// modtime and the modtimes of the directories within the system
+// include directories. Headers are installed, by package managers and
+// the like, by creating or renaming files which updates the modtime of
+// the directory containing them so upgrading a library's headers,
+// without changing the compiler, also causes a rebuild.
+//
+// Determining the system include directories means running the
+// compiler which is too slow to do on every invocation of dcc. The
+// directories are cached in a file along with a "fingerprint" of the
+// compiler executable, its path, size and modtime, and only
+// re-determined if the fingerprint changes. The cache file also
+// records the directories within the system include directories, and
+// their modtimes, so each run need only stat those directories rather
+// than search the system include directories for them.
+//
+type Toolchain struct {
+	Path        string    // compiler executable path
+	ModTime     time.Time // newest of the compiler executable and system include directory modtimes
+	Fingerprint string    // identifies the compiler executable
+	SystemDirs  []string  // system include directories
+}
+
+// ToolchainCacheFilename returns the name of the file used to cache
+// toolchain information for a compiler in an object directory.
+//
+func ToolchainCacheFilename(objdir string, compiler Compiler) string {
+	return filepath.Join(objdir, DepsDir, "toolchain."+filepath.Base(compiler.Name()))
+}
+
+// LoadToolchain returns the Toolchain for a compiler. The system
+// include directories are read from the cache file if its fingerprint
+// matches the compiler, otherwise they're obtained from the compiler
+// and the cache file updated.
+//
+func LoadToolchain(compiler Compiler, cachefile string) (*Toolchain, error) {
+	path, err := exec.LookPath(compiler.Name())
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	tc := &Toolchain{
+		Path:        path,
+		ModTime:     info.ModTime(),
+		Fingerprint: fmt.Sprintf("%s %d %d", path, info.Size(), info.ModTime().UnixNano()),
+	}
+	var headerDirs map[string]time.Time
+	if dirs, recorded, ok := readToolchainCache(cachefile, tc.Fingerprint); ok {
+		tc.SystemDirs = dirs
+		headerDirs = checkHeaderDirs(recorded)
+	} else {
+		if Debug {
+			log.Printf("TOOLCHAIN: probing %q for system include directories", path)
+		}
+		if tc.SystemDirs, err = compiler.SystemIncludeDirs(); err != nil {
+			return nil, err
+		}
+	}
+	if headerDirs == nil {
+		if Debug {
+			log.Printf("TOOLCHAIN: searching system include directories %q", tc.SystemDirs)
+		}
+		headerDirs = findHeaderDirs(tc.SystemDirs)
+		if err := writeToolchainCache(cachefile, tc.Fingerprint, tc.SystemDirs, headerDirs); err != nil {
+			log.Printf("warning: %s", err)
+		}
+	}
+	for _, modtime := range headerDirs {
+		if modtime.After(tc.ModTime) {
+			tc.ModTime = modtime
+		}
+	}
+	return tc, nil
+}
+
+// findHeaderDirs returns the modtimes of the system include
+// directories and all the directories within them.
+//
+func findHeaderDirs(systemDirs []string) map[string]time.Time {
+	headerDirs := make(map[string]time.Time)
+	for _, dir := range systemDirs {
+		filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil || !entry.IsDir() {
+				return nil
+			}
+			if info, err := entry.Info(); err == nil {
+				headerDirs[path] = info.ModTime()
+			}
+			return nil
+		})
+	}
+	return headerDirs
+}
+
+// checkHeaderDirs stats the directories recorded in the toolchain
+// cache file and returns them if none have changed. If any have
+// changed, or no longer exist, nil is returned and the directories
+// must be found again.
+//
+func checkHeaderDirs(recorded map[string]time.Time) map[string]time.Time {
+	for dir, modtime := range recorded {
+		if info, err := os.Stat(dir); err != nil || !info.ModTime().Equal(modtime) {
+			if Debug {
+				log.Printf("TOOLCHAIN: system include directory %q has changed", dir)
+			}
+			return nil
+		}
+	}
+	return recorded
+}
+
+// IsSystemHeader returns true if the named file resides in one of the
+// toolchain's system include directories.
+//
+func (tc *Toolchain) IsSystemHeader(path string) bool {
+	for _, dir := range tc.SystemDirs {
+		if strings.HasPrefix(path, dir) && len(path) > len(dir) && os.IsPathSeparator(path[len(dir)]) {
+			return true
+		}
+	}
+	return false
+}
+
+// The toolchain cache file has the fingerprint on its first line
+// followed by a system include directory on each line. An empty line
+// separates these from the directories within the system include
+// directories, one per line preceded by its modtime.
+//
+func readToolchainCache(path, fingerprint string) ([]string, map[string]time.Time, bool) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, false
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if lines[0] != fingerprint {
+		return nil, nil, false
+	}
+	var dirs []string
+	headerDirs := make(map[string]time.Time)
+	for index, line := range lines[1:] {
+		if line == "" {
+			for _, line := range lines[index+2:] {
+				fields := strings.SplitN(line, " ", 2)
+				if len(fields) != 2 {
+					return nil, nil, false
+				}
+				nanos, err := strconv.ParseInt(fields[0], 10, 64)
+				if err != nil {
+					return nil, nil, false
+				}
+				headerDirs[fields[1]] = time.Unix(0, nanos)
+			}
+			return dirs, headerDirs, true
+		}
+		dirs = append(dirs, line)
+	}
+	return nil, nil, false
+}
+
+func writeToolchainCache(path, fingerprint string, dirs []string, headerDirs map[string]time.Time) error {
+	if err := Mkdir(filepath.Dir(path)); err != nil {
+		return err
+	}
+	var buf strings.Builder
+	fmt.Fprintln(&buf, fingerprint)
+	for _, dir := range dirs {
+		fmt.Fprintln(&buf, dir)
+	}
+	fmt.Fprintln(&buf)
+	for dir, modtime := range headerDirs {
+		fmt.Fprintln(&buf, modtime.UnixNano(), dir)
+	}
+	return ioutil.WriteFile(path, []byte(buf.String()), 0666)
+}
+
+// ParseIncludeSearchList extracts the system include directories from
+// the output of a gcc-style compiler run with the -E and -v options.
+//
+func ParseIncludeSearchList(output string) []string {
+	var dirs []string
+	inList := false
+	input := bufio.NewScanner(strings.NewReader(output))
+	for input.Scan() {
+		line := input.Text()
+		switch {
+		case strings.HasPrefix(line, "#include <...> search starts here:"):
+			inList = true
+		case strings.HasPrefix(line, "End of search list."):
+			inList = false
+		case inList:
+			dir := strings.TrimSpace(strings.TrimSuffix(line, " (framework directory)"))
+			if dir != "" {
+				dirs = append(dirs, filepath.Clean(dir))
+			}
+		}
+	}
+	return dirs
+}
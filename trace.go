@@ -0,0 +1,110 @@
+// dcc - dependency-driven C/C++ compiler front end
+//
+// Copyright © A.Newman 2015.
+//
+// This source code is released under version 2 of the  GNU Public License.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// Build traces.
+//
+// With --trace dcc writes the actions of the build to a file in the
+// Chrome trace event format, as understood by about:tracing and
+// Perfetto. Each action is a "complete" event, a slice of time, on
+// a lane, a thread, per worker. Actions not performed by a worker,
+// i.e. linking, are on the "main" lane.
+//
+
+// traceEvent is an event in the Chrome trace event format.
+//
+type traceEvent struct {
+	Name string            `json:"name"`
+	Cat  string            `json:"cat,omitempty"`
+	Ph   string            `json:"ph"`
+	Ts   int64             `json:"ts"`
+	Dur  int64             `json:"dur"`
+	Pid  int               `json:"pid"`
+	Tid  int               `json:"tid"`
+	Args map[string]string `json:"args,omitempty"`
+}
+
+type traceFile struct {
+	TraceEvents     []traceEvent `json:"traceEvents"`
+	DisplayTimeUnit string       `json:"displayTimeUnit"`
+}
+
+// NewTrace returns the trace of the actions in a build report.
+//
+func NewTrace(report *BuildReport) *traceFile {
+	const pid = 1
+	start := report.StartTime()
+	micros := func(t time.Time) int64 {
+		return t.Sub(start).Microseconds()
+	}
+
+	trace := &traceFile{DisplayTimeUnit: "ms"}
+	lanes := make(map[int]bool)
+	lane := func(worker int) int {
+		tid := worker + 1 // worker -1, none, is the main lane
+		if !lanes[tid] {
+			lanes[tid] = true
+			name := "main"
+			if worker >= 0 {
+				name = fmt.Sprintf("worker %d", worker)
+			}
+			trace.TraceEvents = append(trace.TraceEvents, traceEvent{
+				Name: "thread_name",
+				Ph:   "M",
+				Pid:  pid,
+				Tid:  tid,
+				Args: map[string]string{"name": name},
+			})
+		}
+		return tid
+	}
+
+	for _, a := range report.Actions() {
+		if a.Skipped {
+			continue
+		}
+		status := "ok"
+		if a.Err != nil {
+			status = "failed"
+		}
+		args := map[string]string{"target": a.Target, "status": status}
+		if a.Source != "" {
+			args["source"] = a.Source
+		}
+		trace.TraceEvents = append(trace.TraceEvents, traceEvent{
+			Name: a.Description(),
+			Cat:  a.Kind,
+			Ph:   "X",
+			Ts:   micros(a.Start),
+			Dur:  a.Duration().Microseconds(),
+			Pid:  pid,
+			Tid:  lane(a.Worker),
+			Args: args,
+		})
+	}
+	return trace
+}
+
+// WriteTrace writes the trace of the actions in a build report to a
+// file.
+//
+func WriteTrace(path string, report *BuildReport) error {
+	data, err := json.Marshal(NewTrace(report))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0666)
+}
@@ -0,0 +1,141 @@
+// dcc - dependency-driven C/C++ compiler front end
+//
+// Copyright © A.Newman 2015.
+//
+// This source code is released under version 2 of the  GNU Public License.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Options file variables.
+//
+// Options files reference variables using $VAR or ${VAR}. A variable
+// may be,
+//
+//	- defined on the command line, --define NAME=VALUE
+//	- a dcc built-in variable (builtins.go)
+//	- an environment variable
+//	- set by an options file, !set NAME=VALUE
+//
+// which are searched in that order. Variables set by an options file
+// are scoped to the file and any files it includes. !set-default
+// only sets a variable if it is not already defined, by any means.
+//
+// The words of a variable's value are not split into further words,
+// see words.go.
+//
+// References may supply a default value, ${VAR:-default}, used if
+// the variable is not defined or empty, or require the variable be
+// defined, ${VAR:?message}, raising an error if it is not.
+//
+
+var (
+	definesMutex sync.Mutex
+	defines      = make(map[string]string)
+)
+
+// Define defines a variable from a NAME=VALUE string as supplied to
+// --define. A NAME without a value defines NAME to be "1".
+//
+func Define(definition string) error {
+	name, value := definition, "1"
+	if index := strings.IndexByte(definition, '='); index != -1 {
+		name, value = definition[:index], definition[index+1:]
+	}
+	if !IsVariableName(name) {
+		return fmt.Errorf("%q: invalid variable name", name)
+	}
+	definesMutex.Lock()
+	defer definesMutex.Unlock()
+	defines[name] = value
+	return nil
+}
+
+// IsVariableName returns true if s is a valid variable name.
+//
+func IsVariableName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case c == '_', c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// VariableScope holds the variables set by an options file. Each
+// file has its own scope whose parent is the scope of the file that
+// included it, if any.
+//
+type VariableScope struct {
+	parent *VariableScope
+	vars   map[string][]string
+}
+
+// NewVariableScope returns a new, empty, VariableScope within a
+// parent scope, which may be nil.
+//
+func NewVariableScope(parent *VariableScope) *VariableScope {
+	return &VariableScope{parent: parent, vars: make(map[string][]string)}
+}
+
+// Set sets a variable in the receiver to a list of words.
+//
+func (s *VariableScope) Set(name string, words []string) {
+	s.vars[name] = words
+}
+
+// Lookup returns the words of a variable in the receiver or its
+// parents.
+//
+func (s *VariableScope) Lookup(name string) ([]string, bool) {
+	for ; s != nil; s = s.parent {
+		if words, found := s.vars[name]; found {
+			return words, true
+		}
+	}
+	return nil, false
+}
+
+// LookupVariableWords returns the value of a variable referenced by
+// the options file named by filename with variables in the given
+// scope. Variables set by options files are lists of words, all
+// others are single words.
+//
+func LookupVariableWords(name, filename string, scope *VariableScope) ([]string, bool) {
+	definesMutex.Lock()
+	value, found := defines[name]
+	definesMutex.Unlock()
+	if found {
+		return []string{value}, true
+	}
+	if value, found := LookupBuiltin(name, filename); found {
+		return []string{value}, true
+	}
+	if value, found := os.LookupEnv(name); found {
+		return []string{value}, true
+	}
+	return scope.Lookup(name)
+}
+
+// LookupVariable returns the value of a variable as a string, the
+// words of a variable set by an options file are separated by
+// spaces.
+//
+func LookupVariable(name, filename string, scope *VariableScope) (string, bool) {
+	words, found := LookupVariableWords(name, filename, scope)
+	return strings.Join(words, " "), found
+}
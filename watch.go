@@ -0,0 +1,281 @@
+// dcc - dependency-driven C/C++ compiler front end
+//
+// Copyright © A.Newman 2015.
+//
+// This source code is released under version 2 of the  GNU Public License.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Watch mode.
+//
+// With --watch dcc builds, as usual, and then waits for any of the
+// build's inputs to change and builds again. Each build is done by a
+// separate dcc process, run with the same arguments (less --watch),
+// so each build is exactly what would be done without --watch and
+// only the affected files are re-compiled and re-linked.
+//
+// The build process tells us what its inputs are by writing their
+// names to a file named by the DCCWATCHLIST environment variable.
+// The inputs are the source files, the dependencies of the object
+// files, any options files and the library and other files used
+// when linking.
+//
+
+// WatchListVariable is the name of the environment variable used to
+// pass the name of the watch list file to the build process.
+//
+const WatchListVariable = "DCCWATCHLIST"
+
+// WatchDebounce is how long to wait for changes to stop before
+// starting a build. Editors often write files several times, or
+// write several files, when saving.
+//
+var WatchDebounce = 250 * time.Millisecond
+
+// Watch runs dcc with the given arguments, repeatedly, whenever any of
+// the build's inputs change. Watch only returns if it fails.
+//
+func Watch(args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	listfile, err := ioutil.TempFile("", "dcc-watch-*")
+	if err != nil {
+		return err
+	}
+	listfile.Close()
+	defer os.Remove(listfile.Name())
+
+	watcher, err := NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	for {
+		if err := WriteWatchList(listfile.Name(), nil); err != nil {
+			return err
+		}
+		start := time.Now()
+		cmd := exec.Command(exe, args...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		cmd.Env = append(os.Environ(), WatchListVariable+"="+listfile.Name())
+		runErr := cmd.Run()
+		if _, ok := runErr.(*exec.ExitError); runErr != nil && !ok {
+			return runErr
+		}
+
+		inputs, err := ReadWatchList(listfile.Name())
+		if err != nil {
+			return err
+		}
+		// A build that fails before it gets to compile anything,
+		// e.g. due to an error in an options file, doesn't tell us
+		// its inputs. In that case we rebuild when anything in the
+		// current directory changes.
+		//
+		watchAll := len(inputs) == 0
+		if watchAll {
+			log.Printf("warning: the build did not report its inputs, watching all files in %s", DccCurrentDirectory)
+			if err := watcher.AddDir(DccCurrentDirectory); err != nil {
+				log.Printf("warning: unable to watch %s: %s", DccCurrentDirectory, err)
+			}
+		}
+		watched := make(StringSet)
+		for _, path := range inputs {
+			path = absPath(path)
+			if err := watcher.Add(path); err != nil {
+				log.Printf("warning: unable to watch %s: %s", path, err)
+				continue
+			}
+			watched.Insert(path)
+		}
+
+		status := "ok"
+		if runErr != nil {
+			status = "FAILED"
+		}
+		log.Printf("[%s] build %s in %s, watching %d files", time.Now().Format("15:04:05"), status, time.Since(start).Round(time.Millisecond), len(watched))
+
+		// Inputs may have changed while building. Changes to files
+		// that were already being watched are waiting to be read,
+		// others are found by their modtimes. Either way we build
+		// again, once, without waiting for a further change. Other
+		// changes made during the build, e.g. the build's outputs,
+		// are discarded.
+		//
+		changed := !watchAll && changedSince(watched, start)
+		if err := watcher.Sync(); err != nil {
+			log.Printf("warning: %s", err)
+		}
+		for drained := false; !drained; {
+			select {
+			case path, ok := <-watcher.Events:
+				if !ok {
+					return nil
+				}
+				if !watchAll && affectsWatched(watched, path) {
+					changed = true
+				}
+			default:
+				drained = true
+			}
+		}
+
+		// Wait for a watched file to change, and then for things
+		// to settle down.
+		//
+		for !changed {
+			path, ok := <-watcher.Events
+			if !ok {
+				return nil
+			}
+			changed = watchAll || affectsWatched(watched, path)
+			if changed && Verbose {
+				log.Printf("%s changed", path)
+			}
+		}
+		for settled := false; !settled; {
+			select {
+			case <-watcher.Events:
+			case <-time.After(WatchDebounce):
+				settled = true
+			}
+		}
+	}
+}
+
+// affectsWatched returns true if a path sent by the watcher may be one
+// of the watched files. The watcher sends an empty path if it lost
+// changes and the path of a directory, ending in a separator, if the
+// directory itself was replaced (watcher.go).
+//
+func affectsWatched(watched StringSet, path string) bool {
+	if path == "" || watched.Contains(path) {
+		return true
+	}
+	if strings.HasSuffix(path, string(filepath.Separator)) {
+		for name := range watched {
+			if strings.HasPrefix(name, path) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// changedSince returns true if any of the named files was modified
+// after the given time.
+//
+func changedSince(paths StringSet, t time.Time) bool {
+	for path := range paths {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(t) {
+			if Verbose {
+				log.Printf("%s changed while building", path)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// WatchListFilename returns the name of the file to which a build
+// being run in watch mode writes the names of its inputs, or an empty
+// string if the build is not being run in watch mode.
+//
+func WatchListFilename() string {
+	return os.Getenv(WatchListVariable)
+}
+
+// WriteWatchList writes the names of a build's inputs to a file,
+// one per line.
+//
+func WriteWatchList(filename string, inputs []string) error {
+	return ioutil.WriteFile(filename, []byte(strings.Join(inputs, "\n")+"\n"), 0666)
+}
+
+// ReadWatchList reads the names of a build's inputs written by
+// WriteWatchList.
+//
+func ReadWatchList(filename string) ([]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var inputs []string
+	input := bufio.NewScanner(file)
+	for input.Scan() {
+		if line := input.Text(); line != "" {
+			inputs = append(inputs, line)
+		}
+	}
+	return inputs, input.Err()
+}
+
+// BuildInputs returns the names of the files used as inputs to a
+// build, the source files, their dependencies, the options files
+// read and any library or other files used when linking. The
+// dependencies come from the object directory's dependency database.
+//
+func BuildInputs(sources []string, objdir string, options []*Options, others ...[]string) []string {
+	db := LoadDepsDatabase(DepsDatabasePath(objdir))
+	seen := make(StringSet)
+	var inputs []string
+	add := func(path string) {
+		if path != "" && !seen.Contains(path) {
+			seen.Insert(path)
+			inputs = append(inputs, path)
+		}
+	}
+	for _, source := range sources {
+		add(source)
+		ofile := ObjectFilename(source, objdir)
+		if _, deps, err := db.Dependencies(ofile, DepsFilename(ofile)); err == nil {
+			for _, dep := range deps {
+				add(dep)
+			}
+		}
+	}
+	for _, o := range options {
+		for _, path := range o.Files {
+			add(path)
+		}
+	}
+	for _, paths := range others {
+		for _, path := range paths {
+			if !strings.HasPrefix(path, "-") {
+				add(path)
+			}
+		}
+	}
+	return inputs
+}
+
+// writeBuildInputs writes the watch list if running in watch mode.
+// Errors are reported but otherwise ignored.
+//
+func writeBuildInputs(sources []string, objdir string, options []*Options, others ...[]string) {
+	filename := WatchListFilename()
+	if filename == "" {
+		return
+	}
+	inputs := BuildInputs(sources, objdir, options, others...)
+	if err := WriteWatchList(filename, inputs); err != nil {
+		log.Printf("warning: %s", err)
+	}
+}
@@ -0,0 +1,126 @@
+// dcc - dependency-driven C/C++ compiler front end
+//
+// Copyright © A.Newman 2015.
+//
+// This source code is released under version 2 of the  GNU Public License.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"path/filepath"
+	"sync"
+)
+
+// Watcher reports changes to files.
+//
+// Files are watched by watching the directories containing them, the
+// Watcher reports the path of any file that changes in a watched
+// directory, whether or not that file was explicitly added. This lets
+// a Watcher report the creation of files that don't yet exist and
+// copes with editors that save files by writing a new file and
+// renaming it.
+//
+// Changed paths are sent on the Watcher's Events channel. On Linux
+// changes are detected using inotify, on other platforms by polling.
+// Sync may be used to ensure changes have been reported.
+//
+// Two other values are sent on the Events channel. If a watched
+// directory is itself removed or replaced, e.g. renamed over, the
+// directory's path, ending in a path separator, is sent. Any file
+// within it may have changed. The directory is watched again if it
+// still exists, or when a file within it is next added. An empty
+// path is sent if changes have been lost, e.g. inotify's queue
+// overflowed. Any file may have changed.
+//
+type Watcher struct {
+	Events chan string
+
+	mutex sync.Mutex
+	dirs  StringSet
+	impl  watcherImpl
+}
+
+// watcherImpl is implemented by the platform-specific watchers.
+//
+type watcherImpl interface {
+	addDir(dir string) error
+	addFile(path string) error
+	sync() error
+	close() error
+}
+
+// NewWatcher returns a new Watcher.
+//
+func NewWatcher() (*Watcher, error) {
+	w := &Watcher{
+		Events: make(chan string, 1000),
+		dirs:   make(StringSet),
+	}
+	impl, err := newWatcherImpl(w.Events, w.lost)
+	if err != nil {
+		return nil, err
+	}
+	w.impl = impl
+	return w, nil
+}
+
+// Add starts watching a file for changes. The file need not exist but
+// the directory containing it should.
+//
+func (w *Watcher) Add(path string) error {
+	path = filepath.Clean(path)
+	if err := w.AddDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+	return w.impl.addFile(path)
+}
+
+// AddDir starts watching a directory, reporting changes to any file
+// within it.
+//
+func (w *Watcher) AddDir(dir string) error {
+	dir = filepath.Clean(dir)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if !w.dirs.Contains(dir) {
+		if err := w.impl.addDir(dir); err != nil {
+			return err
+		}
+		w.dirs.Insert(dir)
+	}
+	return nil
+}
+
+// lost is called by the platform-specific watcher when it is no
+// longer watching a directory, so it is watched again when next
+// added.
+//
+func (w *Watcher) lost(dir string) {
+	w.mutex.Lock()
+	w.dirs.Remove(dir)
+	w.mutex.Unlock()
+}
+
+// IsWatching returns true if changes to the named file are being
+// reported.
+//
+func (w *Watcher) IsWatching(path string) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.dirs.Contains(filepath.Dir(filepath.Clean(path)))
+}
+
+// Sync waits until any changes made before it was called have been
+// sent on the receiver's Events channel.
+//
+func (w *Watcher) Sync() error {
+	return w.impl.sync()
+}
+
+// Close stops the Watcher. No further events are sent.
+//
+func (w *Watcher) Close() error {
+	return w.impl.close()
+}
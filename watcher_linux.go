@@ -0,0 +1,209 @@
+// dcc - dependency-driven C/C++ compiler front end
+//
+// Copyright © A.Newman 2015.
+//
+// This source code is released under version 2 of the  GNU Public License.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// inotifyWatcher watches directories using Linux's inotify.
+//
+// The watcher syncs by creating a "cookie" file in a directory of its
+// own. inotify reports events in the order they occur so once the
+// cookie's creation is read all prior changes have been reported.
+//
+// A watch is removed when its directory is deleted, or renamed, in
+// which case the directory, or its replacement, is watched again.
+//
+type inotifyWatcher struct {
+	fd        int // NB. file.Fd() would make the file blocking
+	file      *os.File
+	events    chan<- string
+	lost      func(dir string)
+	mutex     sync.Mutex
+	dirs      map[int32]string // watch descriptor -> directory
+	cookieDir string
+	cookieWd  int32
+	cookies   map[string]chan struct{} // cookie name -> waiting sync
+	ncookies  int
+}
+
+// syncTimeout limits the time waiting for a sync cookie to be seen.
+//
+const syncTimeout = 10 * time.Second
+
+var errSyncTimeout = errors.New("timed out waiting for file change notifications")
+
+const inotifyMask = syscall.IN_MODIFY |
+	syscall.IN_ATTRIB |
+	syscall.IN_CLOSE_WRITE |
+	syscall.IN_CREATE |
+	syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM |
+	syscall.IN_MOVED_TO |
+	syscall.IN_DELETE_SELF |
+	syscall.IN_MOVE_SELF
+
+func newWatcherImpl(events chan<- string, lost func(dir string)) (watcherImpl, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	w := &inotifyWatcher{
+		fd:      fd,
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		events:  events,
+		lost:    lost,
+		dirs:    make(map[int32]string),
+		cookies: make(map[string]chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *inotifyWatcher) addDir(dir string) error {
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, inotifyMask)
+	if err != nil {
+		return &os.PathError{Op: "inotify_add_watch", Path: dir, Err: err}
+	}
+	w.mutex.Lock()
+	w.dirs[int32(wd)] = dir
+	w.mutex.Unlock()
+	return nil
+}
+
+func (w *inotifyWatcher) addFile(string) error {
+	return nil // directories are watched, not files
+}
+
+func (w *inotifyWatcher) sync() error {
+	w.mutex.Lock()
+	if w.cookieDir == "" {
+		dir, err := ioutil.TempDir("", "dcc-watcher-")
+		if err != nil {
+			w.mutex.Unlock()
+			return err
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, dir, syscall.IN_CREATE)
+		if err != nil {
+			w.mutex.Unlock()
+			os.Remove(dir)
+			return &os.PathError{Op: "inotify_add_watch", Path: dir, Err: err}
+		}
+		w.cookieDir, w.cookieWd = dir, int32(wd)
+	}
+	w.ncookies++
+	name := strconv.Itoa(w.ncookies)
+	path := filepath.Join(w.cookieDir, name)
+	seen := make(chan struct{})
+	w.cookies[name] = seen
+	w.mutex.Unlock()
+
+	defer func() {
+		w.mutex.Lock()
+		delete(w.cookies, name)
+		w.mutex.Unlock()
+		os.Remove(path)
+	}()
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	file.Close()
+	select {
+	case <-seen:
+		return nil
+	case <-time.After(syncTimeout):
+		return errSyncTimeout
+	}
+}
+
+func (w *inotifyWatcher) close() error {
+	w.mutex.Lock()
+	if w.cookieDir != "" {
+		os.RemoveAll(w.cookieDir)
+	}
+	w.mutex.Unlock()
+	return w.file.Close()
+}
+
+// run reads inotify events and sends the paths of the files they
+// refer to to the events channel. It stops when the inotify file is
+// closed.
+//
+func (w *inotifyWatcher) run() {
+	defer close(w.events)
+	var buf [64 * 1024]byte
+	for {
+		n, err := w.file.Read(buf[:])
+		if err != nil {
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			nameEnd := nameStart + int(event.Len)
+			offset = nameEnd
+			if nameEnd > n {
+				break
+			}
+			name := string(buf[nameStart:nameEnd])
+			for len(name) > 0 && name[len(name)-1] == 0 {
+				name = name[:len(name)-1]
+			}
+			if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				w.events <- ""
+				continue
+			}
+			w.mutex.Lock()
+			dir, found := w.dirs[event.Wd]
+			if event.Wd == w.cookieWd && w.cookieDir != "" {
+				if seen, found := w.cookies[name]; found {
+					close(seen)
+					delete(w.cookies, name)
+				}
+				found = false
+			}
+			w.mutex.Unlock()
+			switch {
+			case !found:
+			case event.Mask&syscall.IN_MOVE_SELF != 0:
+				// The watch follows the directory to its new
+				// name. Removing it results in IN_IGNORED.
+				syscall.InotifyRmWatch(w.fd, uint32(event.Wd))
+			case event.Mask&syscall.IN_IGNORED != 0:
+				w.rewatch(event.Wd, dir)
+				w.events <- dir + string(filepath.Separator)
+			case name != "":
+				w.events <- filepath.Join(dir, name)
+			}
+		}
+	}
+}
+
+// rewatch replaces a removed watch by watching the directory's
+// pathname again. If the directory no longer exists it is watched
+// when next added.
+//
+func (w *inotifyWatcher) rewatch(wd int32, dir string) {
+	w.mutex.Lock()
+	delete(w.dirs, wd)
+	w.mutex.Unlock()
+	if err := w.addDir(dir); err != nil {
+		w.lost(dir)
+	}
+}
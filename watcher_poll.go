@@ -0,0 +1,143 @@
+// dcc - dependency-driven C/C++ compiler front end
+//
+// Copyright © A.Newman 2015.
+//
+// This source code is released under version 2 of the  GNU Public License.
+// See the file LICENSE for details.
+//
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// PollInterval is how often a polling watcher checks for changes.
+//
+const PollInterval = 500 * time.Millisecond
+
+// pollingWatcher detects changes by periodically listing the watched
+// directories and comparing the modtimes and sizes of their files.
+//
+type pollingWatcher struct {
+	events chan<- string
+	mutex  sync.Mutex
+	state  map[string]map[string]fileState // dir -> name -> state
+	syncs  chan chan struct{}
+	stop   chan struct{}
+}
+
+type fileState struct {
+	modtime time.Time
+	size    int64
+}
+
+func newWatcherImpl(events chan<- string, lost func(dir string)) (watcherImpl, error) {
+	w := &pollingWatcher{
+		events: events,
+		state:  make(map[string]map[string]fileState),
+		syncs:  make(chan chan struct{}),
+		stop:   make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *pollingWatcher) addDir(dir string) error {
+	state, err := readDirState(dir)
+	if err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	w.state[dir] = state
+	w.mutex.Unlock()
+	return nil
+}
+
+func (w *pollingWatcher) addFile(string) error {
+	return nil // directories are watched, not files
+}
+
+// sync has the watcher check for changes now, rather than waiting for
+// the next poll, and waits for it to have done so.
+//
+func (w *pollingWatcher) sync() error {
+	done := make(chan struct{})
+	select {
+	case w.syncs <- done:
+	case <-w.stop:
+		return nil
+	}
+	<-done
+	return nil
+}
+
+func (w *pollingWatcher) close() error {
+	close(w.stop)
+	return nil
+}
+
+func readDirState(dir string) (map[string]fileState, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	state := make(map[string]fileState, len(infos))
+	for _, info := range infos {
+		state[info.Name()] = fileState{info.ModTime(), info.Size()}
+	}
+	return state, nil
+}
+
+func (w *pollingWatcher) run() {
+	defer close(w.events)
+	ticker := time.NewTicker(PollInterval)
+	defer ticker.Stop()
+	for {
+		var done chan struct{}
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		case done = <-w.syncs:
+		}
+		w.poll()
+		if done != nil {
+			close(done)
+		}
+	}
+}
+
+// poll checks the watched directories for changes.
+//
+func (w *pollingWatcher) poll() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for dir, prev := range w.state {
+		curr, err := readDirState(dir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				continue
+			}
+			curr = make(map[string]fileState)
+		}
+		for name, s := range curr {
+			if p, found := prev[name]; !found || p != s {
+				w.events <- filepath.Join(dir, name)
+			}
+		}
+		for name := range prev {
+			if _, found := curr[name]; !found {
+				w.events <- filepath.Join(dir, name)
+			}
+		}
+		w.state[dir] = curr
+	}
+}
@@ -0,0 +1,146 @@
+// dcc - dependency-driven C/C++ compiler front end
+//
+// Copyright © A.Newman 2015.
+//
+// This source code is released under version 2 of the  GNU Public License.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestWatcherSync(t *testing.T) {
+	setupTest(t)
+	defer removeTestDirs(t)
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	path, err := filepath.Abs(filepath.Join(testProjectRootDir, "watched.h"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	makeFileWithContent(t, path, "before")
+	if err := w.Add(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once synced the change must have been reported, without
+	// waiting.
+	//
+	makeFileWithContent(t, path, "after")
+	if err := w.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		select {
+		case changed := <-w.Events:
+			if changed == path {
+				return
+			}
+		default:
+			t.Fatalf("change to %q not reported by Sync", path)
+		}
+	}
+}
+
+func TestWatcherDirectoryReplaced(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("polling watchers watch directory contents, not the directories")
+	}
+	setupTest(t)
+	defer removeTestDirs(t)
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	dir, err := filepath.Abs(filepath.Join(testProjectRootDir, "include"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "watched.h")
+	if err := os.Mkdir(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	makeFileWithContent(t, path, "before")
+	if err := w.Add(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the directory. The watcher reports the directory and
+	// watches its replacement.
+	//
+	if err := os.Rename(dir, dir+".old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	makeFileWithContent(t, path, "after")
+	expectEvent := func(expected string) {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case changed := <-w.Events:
+				if changed == expected {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("change to %q not reported", expected)
+			}
+		}
+	}
+	expectEvent(dir + string(filepath.Separator))
+	if err := w.Add(path); err != nil {
+		t.Fatal(err)
+	}
+	makeFileWithContent(t, path, "again")
+	expectEvent(path)
+}
+
+func TestWatcherAddDir(t *testing.T) {
+	setupTest(t)
+	defer removeTestDirs(t)
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	dir, err := filepath.Abs(testProjectRootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "new.c")
+	makeFile(t, path)
+	if err := w.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		select {
+		case changed := <-w.Events:
+			if changed == path {
+				return
+			}
+		default:
+			t.Fatalf("creation of %q not reported", path)
+		}
+	}
+}
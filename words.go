@@ -0,0 +1,231 @@
+// dcc - dependency-driven C/C++ compiler front end
+//
+// Copyright © A.Newman 2015.
+//
+// This source code is released under version 2 of the  GNU Public License.
+// See the file LICENSE for details.
+//
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Words.
+//
+// Lines in options files are split into words, options, using rules
+// similar to the POSIX shell's.
+//
+//	- words are separated by spaces and tabs
+//	- text within single quotes is used literally
+//	- text within double quotes is used literally other than
+//	  variable references and the backslash escapes \", \\ and \$
+//	- outside of quotes a backslash escapes a following space, tab,
+//	  quote, backslash or $; other backslashes are literal so
+//	  Windows paths, C:\include, need no escaping
+//	- variable references, $VAR and ${VAR}, are expanded
+//
+// Unlike the shell the value of a variable is not split into words,
+// a variable's value containing spaces remains a single word, unless
+// requested using ${=VAR}. Variables set in options files, via !set,
+// hold a list of words. Referenced outside of quotes a variable set
+// to more than one word results in more than one word.
+//
+
+// SplitWords splits a line into words, expanding any variable
+// references using the lookup function to obtain the words of a
+// variable's value.
+//
+func SplitWords(s string, lookup func(string) ([]string, bool)) ([]string, error) {
+	var (
+		words   []string
+		word    strings.Builder
+		started bool // true if word has started, quotes start a, possibly empty, word
+	)
+	endWord := func() {
+		if started {
+			words = append(words, word.String())
+			word.Reset()
+			started = false
+		}
+	}
+	splice := func(values []string) {
+		if len(values) == 1 && values[0] == "" {
+			return
+		}
+		for i, value := range values {
+			if i > 0 {
+				endWord()
+			}
+			word.WriteString(value)
+			started = true
+		}
+	}
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case ' ', '\t':
+			endWord()
+
+		case '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated single quote")
+			}
+			word.WriteString(s[i+1 : i+1+end])
+			started = true
+			i += end + 1
+
+		case '"':
+			started = true
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				switch {
+				case s[j] == '\\' && j+1 < len(s) && strings.IndexByte("\"\\$", s[j+1]) != -1:
+					j++
+					word.WriteByte(s[j])
+				case s[j] == '$':
+					values, n, err := expandReference(s[j:], lookup)
+					if err != nil {
+						return nil, err
+					}
+					word.WriteString(strings.Join(values, " "))
+					j += n - 1
+				default:
+					word.WriteByte(s[j])
+				}
+			}
+			if j == len(s) {
+				return nil, fmt.Errorf("unterminated double quote")
+			}
+			i = j
+
+		case '\\':
+			if i+1 < len(s) && strings.IndexByte(" \t'\"\\$", s[i+1]) != -1 {
+				i++
+			}
+			word.WriteByte(s[i])
+			started = true
+
+		case '$':
+			values, n, err := expandReference(s[i:], lookup)
+			if err != nil {
+				return nil, err
+			}
+			splice(values)
+			i += n - 1
+
+		default:
+			word.WriteByte(c)
+			started = true
+		}
+	}
+	endWord()
+	return words, nil
+}
+
+// expandReference expands the variable reference at the start of s
+// returning the words of its value and the length of the reference.
+// A $ that doesn't start a reference is returned as is.
+//
+func expandReference(s string, lookup func(string) ([]string, bool)) ([]string, int, error) {
+	var ref string
+	var n int
+	switch {
+	case len(s) > 1 && s[1] == '{':
+		if n = closingBrace(s); n == -1 {
+			return nil, 0, fmt.Errorf("unterminated variable reference")
+		}
+		ref, n = s[2:n], n+1
+	default:
+		for n = 1; n < len(s) && isNameChar(s[n]); n++ {
+		}
+		if n == 1 {
+			return []string{"$"}, 1, nil
+		}
+		ref = s[1:n]
+	}
+
+	split := strings.HasPrefix(ref, "=")
+	if split {
+		ref = ref[1:]
+	}
+	name, op, arg := parseReference(ref)
+	values, _ := lookup(name)
+	if strings.Join(values, "") == "" {
+		switch op {
+		case ":-":
+			var err error
+			if values, err = SplitWords(arg, lookup); err != nil {
+				return nil, 0, err
+			}
+		case ":?":
+			if arg == "" {
+				arg = "not defined"
+			}
+			return nil, 0, fmt.Errorf("%s: %s", name, arg)
+		}
+	}
+	if split {
+		values = strings.Fields(strings.Join(values, " "))
+	}
+	return values, n, nil
+}
+
+// closingBrace returns the index of the } ending the ${...} reference
+// at the start of s, allowing for nested references, or -1 if there
+// is none.
+//
+func closingBrace(s string) int {
+	depth := 0
+	for i := 1; i < len(s); i++ {
+		if s[i] == '{' {
+			depth++
+		} else if s[i] == '}' {
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// ExpandReferences replaces the variable references in a string with
+// the words of their values, separated by spaces. Unlike SplitWords
+// the string is not split into words and quotes and backslashes are
+// copied as is. This is used to expand the values in the expressions
+// of !if and !elif (expr.go).
+//
+func ExpandReferences(s string, lookup func(string) ([]string, bool)) (string, error) {
+	var result strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' {
+			result.WriteByte(s[i])
+			continue
+		}
+		values, n, err := expandReference(s[i:], lookup)
+		if err != nil {
+			return "", err
+		}
+		result.WriteString(strings.Join(values, " "))
+		i += n - 1
+	}
+	return result.String(), nil
+}
+
+// parseReference splits the text of a variable reference, the part
+// within ${}, into the variable's name and any operator, :- or :?,
+// and its argument.
+//
+func parseReference(ref string) (name, op, arg string) {
+	if index := strings.Index(ref, ":"); index != -1 && index+1 < len(ref) {
+		return ref[:index], ref[index : index+2], ref[index+2:]
+	}
+	return ref, "", ""
+}
+
+func isNameChar(c byte) bool {
+	return c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9'
+}